@@ -0,0 +1,418 @@
+package optimizer
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultCatalogJSON is the catalog of the standard order report. It is
+// used whenever no catalog file is given.
+//
+//go:embed catalog.json
+var defaultCatalogJSON []byte
+
+// Column flags understood by the optimizer.
+const (
+	FlagRequired = "REQUIRED"
+	FlagDefault  = "DEFAULT"
+)
+
+// Built-in preset names. A catalog may store a preset named "default" to
+// have it checked against the DEFAULT flags; "all" cannot be redefined.
+const (
+	PresetAll     = "all"
+	PresetDefault = "default"
+)
+
+// CatalogEntry describes one selectable column: the alias of its select
+// expression in the template and the metadata shown to the user.
+//
+// Instead of the individual fields an entry may give the whole description
+// as a Spec string in the mini-language understood by ParseColumnSpec.
+type CatalogEntry struct {
+	Alias           string   `json:"alias" yaml:"alias"`
+	Spec            string   `json:"spec,omitempty" yaml:"spec,omitempty"`
+	Display         string   `json:"display,omitempty" yaml:"display,omitempty"`
+	Section         string   `json:"section,omitempty" yaml:"section,omitempty"`
+	SectionOrder    int      `json:"section_order,omitempty" yaml:"section_order,omitempty"`
+	Subsection      string   `json:"subsection,omitempty" yaml:"subsection,omitempty"`
+	SubsectionOrder int      `json:"subsection_order,omitempty" yaml:"subsection_order,omitempty"`
+	Type            string   `json:"type,omitempty" yaml:"type,omitempty"`
+	Enum            []string `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Flags           []string `json:"flags,omitempty" yaml:"flags,omitempty"`
+}
+
+// applySpec fills the entry's fields from its Spec string.
+func (e *CatalogEntry) applySpec() error {
+	if e.Display != "" || e.Section != "" || e.Subsection != "" || e.Type != "" || len(e.Enum) > 0 || len(e.Flags) > 0 {
+		return fmt.Errorf("spec and individual fields are mutually exclusive")
+	}
+	spec, err := ParseColumnSpec(e.Spec)
+	if err != nil {
+		return err
+	}
+	e.Display = spec.Label
+	e.Section, e.SectionOrder = spec.Section, spec.SectionOrder
+	e.Subsection, e.SubsectionOrder = spec.Subsection, spec.SubsectionOrder
+	e.Type = spec.Type
+	e.Enum = spec.Enum
+	if spec.Required {
+		e.Flags = append(e.Flags, FlagRequired)
+	}
+	if spec.Default {
+		e.Flags = append(e.Flags, FlagDefault)
+	}
+	return nil
+}
+
+// HasFlag reports whether the entry carries the given flag.
+func (e CatalogEntry) HasFlag(flag string) bool {
+	return slices.Contains(e.Flags, flag)
+}
+
+func (e CatalogEntry) String() string {
+	name := e.Section + ": " + e.Subsection + " -> " + e.Display
+	if len(e.Flags) > 0 {
+		name += " (" + strings.Join(e.Flags, ", ") + ")"
+	}
+	return name
+}
+
+// Catalog is the ordered list of columns a user can select. The index of
+// an entry is the number shown in the interactive prompt.
+type Catalog struct {
+	Columns []CatalogEntry          `json:"columns" yaml:"columns"`
+	Presets map[string][]PresetItem `json:"presets,omitempty" yaml:"presets,omitempty"`
+	// Joins describes joins of the template, keyed by the join's alias.
+	Joins map[string]JoinInfo `json:"joins,omitempty" yaml:"joins,omitempty"`
+}
+
+// PresetItem is one reference of a named preset: a single alias, a whole
+// section, a whole subsection, or a subsection of a given section. In a
+// catalog file a plain string is read as an alias.
+type PresetItem struct {
+	Alias      string `json:"alias,omitempty" yaml:"alias,omitempty"`
+	Section    string `json:"section,omitempty" yaml:"section,omitempty"`
+	Subsection string `json:"subsection,omitempty" yaml:"subsection,omitempty"`
+}
+
+func (p *PresetItem) UnmarshalJSON(data []byte) error {
+	var alias string
+	if err := json.Unmarshal(data, &alias); err == nil {
+		*p = PresetItem{Alias: alias}
+		return nil
+	}
+	type plain PresetItem
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+func (p *PresetItem) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*p = PresetItem{Alias: node.Value}
+		return nil
+	}
+	type plain PresetItem
+	return node.Decode((*plain)(p))
+}
+
+func (p PresetItem) String() string {
+	switch {
+	case p.Alias != "":
+		return p.Alias
+	case p.Section != "" && p.Subsection != "":
+		return fmt.Sprintf("subsection %q of section %q", p.Subsection, p.Section)
+	case p.Section != "":
+		return fmt.Sprintf("section %q", p.Section)
+	}
+	return fmt.Sprintf("subsection %q", p.Subsection)
+}
+
+// matches reports whether the item selects the entry.
+func (p PresetItem) matches(entry CatalogEntry) bool {
+	if p.Alias != "" {
+		return entry.Alias == p.Alias
+	}
+	return (p.Section == "" || p.Section == entry.Section) &&
+		(p.Subsection == "" || p.Subsection == entry.Subsection)
+}
+
+// PresetDrift lists the differences between a stored preset and the
+// DEFAULT flags of the catalog.
+type PresetDrift struct {
+	// Unflagged holds aliases the stored preset selects although they are
+	// not flagged DEFAULT.
+	Unflagged []string
+	// Missing holds aliases flagged DEFAULT that the stored preset does
+	// not select.
+	Missing []string
+}
+
+// Empty reports whether the stored preset and the flags agree.
+func (d PresetDrift) Empty() bool {
+	return len(d.Unflagged) == 0 && len(d.Missing) == 0
+}
+
+func (d PresetDrift) String() string {
+	var parts []string
+	if len(d.Unflagged) > 0 {
+		parts = append(parts, "selected but not flagged DEFAULT: "+strings.Join(d.Unflagged, ", "))
+	}
+	if len(d.Missing) > 0 {
+		parts = append(parts, "flagged DEFAULT but not selected: "+strings.Join(d.Missing, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// DefaultCatalog returns the embedded catalog of the standard order report.
+func DefaultCatalog() *Catalog {
+	catalog, err := ParseCatalog(defaultCatalogJSON, "json")
+	if err != nil {
+		panic(fmt.Sprintf("embedded catalog: %v", err))
+	}
+	return catalog
+}
+
+// LoadCatalog reads a catalog file. Files ending in .yaml or .yml are read
+// as YAML, everything else as JSON.
+func LoadCatalog(path string) (*Catalog, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCatalog(data, fileFormat(path))
+}
+
+// fileFormat returns the format a file is read in by its extension: "yaml"
+// for .yaml and .yml, "json" for anything else.
+func fileFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "json"
+}
+
+// ParseCatalog decodes and validates a catalog in the given format, which
+// is either "json" or "yaml".
+func ParseCatalog(data []byte, format string) (*Catalog, error) {
+	var catalog Catalog
+	var err error
+	switch format {
+	case "json":
+		err = json.Unmarshal(data, &catalog)
+	case "yaml":
+		err = yaml.Unmarshal(data, &catalog)
+	default:
+		return nil, fmt.Errorf("unknown catalog format %q", format)
+	}
+	if err != nil {
+		return nil, &CatalogError{Entry: -1, Reason: err.Error()}
+	}
+	if err := catalog.validate(); err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+func (c *Catalog) validate() error {
+	if len(c.Columns) == 0 {
+		return &CatalogError{Entry: -1, Reason: "catalog has no columns"}
+	}
+	seen := make(map[string]bool)
+	for i := range c.Columns {
+		entry := &c.Columns[i]
+		if entry.Spec != "" {
+			if err := entry.applySpec(); err != nil {
+				return &CatalogError{Entry: i, Alias: entry.Alias, Reason: err.Error()}
+			}
+		}
+		if entry.Alias == "" {
+			return &CatalogError{Entry: i, Reason: "alias is empty"}
+		}
+		if seen[entry.Alias] {
+			return &CatalogError{Entry: i, Alias: entry.Alias, Reason: "alias is listed more than once"}
+		}
+		seen[entry.Alias] = true
+		if entry.Display == "" {
+			return &CatalogError{Entry: i, Alias: entry.Alias, Reason: "display name is empty"}
+		}
+		if entry.Type != "" && entry.Type != TypeInteger && entry.Type != TypeDate {
+			return &CatalogError{Entry: i, Alias: entry.Alias, Reason: fmt.Sprintf("unknown type %q", entry.Type)}
+		}
+		for _, flag := range entry.Flags {
+			if flag != FlagRequired && flag != FlagDefault {
+				return &CatalogError{Entry: i, Alias: entry.Alias, Reason: fmt.Sprintf("unknown flag %q", flag)}
+			}
+		}
+	}
+
+	for name, items := range c.Presets {
+		if name == "" || name == PresetAll {
+			return &CatalogError{Entry: -1, Reason: fmt.Sprintf("preset name %q is reserved", name)}
+		}
+		if len(items) == 0 {
+			return &CatalogError{Entry: -1, Reason: fmt.Sprintf("preset %q selects nothing", name)}
+		}
+		for _, item := range items {
+			if item.Alias != "" && (item.Section != "" || item.Subsection != "") {
+				return &CatalogError{Entry: -1, Reason: fmt.Sprintf("preset %q: an item names either an alias or a section, not both", name)}
+			}
+			if item.Alias == "" && item.Section == "" && item.Subsection == "" {
+				return &CatalogError{Entry: -1, Reason: fmt.Sprintf("preset %q: empty item", name)}
+			}
+			if slices.IndexFunc(c.Columns, item.matches) == -1 {
+				return &CatalogError{Entry: -1, Reason: fmt.Sprintf("preset %q: %s is not in the catalog", name, item)}
+			}
+		}
+	}
+
+	for alias, join := range c.Joins {
+		if err := join.validate(alias); err != nil {
+			return &CatalogError{Entry: -1, Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// Aliases returns the aliases of the catalog in index order.
+func (c *Catalog) Aliases() []string {
+	aliases := make([]string, len(c.Columns))
+	for i, entry := range c.Columns {
+		aliases[i] = entry.Alias
+	}
+	return aliases
+}
+
+// ColumnSpecs returns the structured description of every entry in index
+// order. Section and subsection orders that the catalog leaves out are
+// numbered by first appearance.
+func (c *Catalog) ColumnSpecs() []ColumnSpec {
+	sectionOrders := make(map[string]int)
+	subsectionOrders := make(map[string]map[string]int)
+	specs := make([]ColumnSpec, len(c.Columns))
+	for i, entry := range c.Columns {
+		if _, ok := sectionOrders[entry.Section]; !ok {
+			sectionOrders[entry.Section] = len(sectionOrders) + 1
+			subsectionOrders[entry.Section] = make(map[string]int)
+		}
+		subsections := subsectionOrders[entry.Section]
+		if _, ok := subsections[entry.Subsection]; !ok {
+			subsections[entry.Subsection] = len(subsections) + 1
+		}
+
+		spec := ColumnSpec{
+			Section:         entry.Section,
+			SectionOrder:    entry.SectionOrder,
+			Subsection:      entry.Subsection,
+			SubsectionOrder: entry.SubsectionOrder,
+			Label:           entry.Display,
+			Type:            entry.Type,
+			Required:        entry.HasFlag(FlagRequired),
+			Enum:            entry.Enum,
+			Default:         entry.HasFlag(FlagDefault),
+		}
+		if spec.SectionOrder == 0 {
+			spec.SectionOrder = sectionOrders[entry.Section]
+		}
+		if spec.SubsectionOrder == 0 {
+			spec.SubsectionOrder = subsections[entry.Subsection]
+		}
+		specs[i] = spec
+	}
+	return specs
+}
+
+// Index returns the index of the entry with the given alias, or -1.
+func (c *Catalog) Index(alias string) int {
+	return slices.IndexFunc(c.Columns, func(entry CatalogEntry) bool {
+		return entry.Alias == alias
+	})
+}
+
+// Preset returns the aliases selected by a preset in index order. Besides
+// the catalog's named presets there are "all" and "default", which selects
+// every entry flagged DEFAULT.
+func (c *Catalog) Preset(name string) ([]string, error) {
+	switch name {
+	case PresetAll:
+		return c.Aliases(), nil
+	case PresetDefault:
+		return c.flagged(FlagDefault), nil
+	}
+	items, ok := c.Presets[name]
+	if !ok {
+		return nil, &UnknownPresetError{Name: name}
+	}
+	return c.selectItems(items), nil
+}
+
+// PresetNames returns the names of the catalog's named presets, sorted.
+// The stored "default" preset is not listed, as selecting "default" always
+// follows the DEFAULT flags.
+func (c *Catalog) PresetNames() []string {
+	var names []string
+	for name := range c.Presets {
+		if name != PresetDefault {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectItems returns the aliases of the entries matched by any of the
+// items, in index order.
+func (c *Catalog) selectItems(items []PresetItem) []string {
+	var aliases []string
+	for _, entry := range c.Columns {
+		for _, item := range items {
+			if item.matches(entry) {
+				aliases = append(aliases, entry.Alias)
+				break
+			}
+		}
+	}
+	return aliases
+}
+
+// flagged returns the aliases of the entries carrying flag, in index order.
+func (c *Catalog) flagged(flag string) []string {
+	var aliases []string
+	for _, entry := range c.Columns {
+		if entry.HasFlag(flag) {
+			aliases = append(aliases, entry.Alias)
+		}
+	}
+	return aliases
+}
+
+// DefaultDrift compares the catalog's stored "default" preset with its
+// DEFAULT flags. The drift is empty when the catalog stores no preset.
+func (c *Catalog) DefaultDrift() PresetDrift {
+	var drift PresetDrift
+	items, ok := c.Presets[PresetDefault]
+	if !ok {
+		return drift
+	}
+	stored := c.selectItems(items)
+	flagged := c.flagged(FlagDefault)
+	for _, alias := range stored {
+		if !slices.Contains(flagged, alias) {
+			drift.Unflagged = append(drift.Unflagged, alias)
+		}
+	}
+	for _, alias := range flagged {
+		if !slices.Contains(stored, alias) {
+			drift.Missing = append(drift.Missing, alias)
+		}
+	}
+	return drift
+}
@@ -0,0 +1,59 @@
+package optimizer
+
+import (
+	"strconv"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// clauses returns the parts of a select besides its select list and FROM
+// clause that read columns: WHERE, GROUP BY, HAVING, ORDER BY and LIMIT.
+func clauses(sel *sqlparser.Select) []sqlparser.SQLNode {
+	return []sqlparser.SQLNode{sel.Where, sel.GroupBy, sel.Having, sel.OrderBy, sel.Limit}
+}
+
+// inlineSelectRefs rewrites the references GROUP BY, HAVING and ORDER BY
+// make to the select list so that they survive pruning it: names of the
+// pruned expressions in dropped, and positions such as ORDER BY 2, are
+// replaced by the expressions they stand for.
+func inlineSelectRefs(sel *sqlparser.Select, dropped map[string]sqlparser.Expr) {
+	selectExprs := sel.SelectExprs
+	inline := func(root sqlparser.Expr, positional bool) sqlparser.Expr {
+		if val, ok := root.(*sqlparser.SQLVal); ok && positional && val.Type == sqlparser.IntVal {
+			position, err := strconv.Atoi(string(val.Val))
+			if err == nil && position >= 1 && position <= len(selectExprs) {
+				if expr, ok := selectExprs[position-1].(*sqlparser.AliasedExpr); ok {
+					return expr.Expr
+				}
+			}
+			return root
+		}
+
+		var refs []*sqlparser.ColName
+		_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+			switch node := node.(type) {
+			case *sqlparser.ColName:
+				if _, ok := dropped[node.Name.String()]; ok && node.Qualifier.IsEmpty() {
+					refs = append(refs, node)
+				}
+			case *sqlparser.Subquery:
+				return false, nil
+			}
+			return true, nil
+		}, root)
+		for _, ref := range refs {
+			root = sqlparser.ReplaceExpr(root, ref, dropped[ref.Name.String()])
+		}
+		return root
+	}
+
+	for i := range sel.GroupBy {
+		sel.GroupBy[i] = inline(sel.GroupBy[i], true)
+	}
+	if sel.Having != nil {
+		sel.Having.Expr = inline(sel.Having.Expr, false)
+	}
+	for _, order := range sel.OrderBy {
+		order.Expr = inline(order.Expr, true)
+	}
+}
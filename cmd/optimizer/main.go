@@ -0,0 +1,163 @@
+// Command optimizer prunes a report template down to the selected columns
+// and the joins they need.
+//
+//	optimizer -template report.sql -preset default -out report.min.sql
+//	optimizer -template report.sql -columns order_id,5,common_name -lineage lineage.json
+//	optimizer -template report.sql -preset default -retained retained.json
+//	optimizer -template report.sql -preset all -schema schema.sql
+//	optimizer -template report.sql -schema schema.sql -validate
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/adarsh-kn-digicert/optimizer"
+)
+
+func main() {
+	templatePath := flag.String("template", "", "path of the SQL template to prune (required)")
+	catalogPath := flag.String("catalog", "", "path of a JSON or YAML column catalog (default: embedded catalog)")
+	columnList := flag.String("columns", "", `comma separated column aliases, catalog indexes, section:"name" or subsection:"name"; prefix with - to deselect`)
+	preset := flag.String("preset", "", "column preset to select: all, default or a named preset")
+	joinsPath := flag.String("joins", "", "path of a JSON or YAML file declaring the cardinality of joins by alias")
+	schemaPaths := flag.String("schema", "", "comma separated paths of CREATE TABLE files, used to resolve unqualified columns")
+	outPath := flag.String("out", "", "path to write the optimized SQL to (default stdout)")
+	lineagePath := flag.String("lineage", "", "path to write the column lineage JSON to")
+	retainedPath := flag.String("retained", "", "path to write the JSON of the joins kept for the row count to")
+	quiet := flag.Bool("quiet", false, "suppress diagnostics on stderr")
+	validate := flag.Bool("validate", false, "only check the template's tables and columns against -schema")
+	flag.Parse()
+
+	if *validate {
+		if *templatePath == "" || *schemaPaths == "" {
+			fmt.Fprintln(os.Stderr, "optimizer: -validate needs -template and -schema")
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := validateTemplate(*templatePath, *schemaPaths); err != nil {
+			fmt.Fprintf(os.Stderr, "optimizer: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *templatePath == "" || (*columnList == "" && *preset == "") {
+		fmt.Fprintln(os.Stderr, "optimizer: -template and one of -columns or -preset are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*templatePath, *catalogPath, *joinsPath, *schemaPaths, *columnList, *preset, *outPath, *lineagePath, *retainedPath, *quiet); err != nil {
+		fmt.Fprintf(os.Stderr, "optimizer: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(templatePath, catalogPath, joinsPath, schemaPaths, columnList, preset, outPath, lineagePath, retainedPath string, quiet bool) error {
+	catalog := optimizer.DefaultCatalog()
+	if catalogPath != "" {
+		var err error
+		catalog, err = optimizer.LoadCatalog(catalogPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	var joins map[string]optimizer.JoinInfo
+	if joinsPath != "" {
+		var err error
+		joins, err = optimizer.LoadJoins(joinsPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	var schema *optimizer.Schema
+	if schemaPaths != "" {
+		var err error
+		schema, err = optimizer.LoadSchema(strings.Split(schemaPaths, ",")...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the preset's aliases go first so that deselections in -columns
+	// apply to them as well
+	var refs []string
+	if preset != "" {
+		presetColumns, err := catalog.Preset(preset)
+		if err != nil {
+			return err
+		}
+		if drift := catalog.DefaultDrift(); preset == optimizer.PresetDefault && !drift.Empty() && !quiet {
+			fmt.Fprintf(os.Stderr, "optimizer: warning: stored DEFAULT preset differs from the catalog flags (%s)\n", drift)
+		}
+		refs = append(refs, presetColumns...)
+	}
+	refs = append(refs, optimizer.SplitRefs(columnList)...)
+	columns, err := catalog.Resolve(refs)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return err
+	}
+
+	var log io.Writer
+	if !quiet {
+		log = os.Stderr
+	}
+	result, err := optimizer.Optimize(string(data), columns, optimizer.Options{Log: log, Catalog: catalog, Joins: joins, Schema: schema})
+	if err != nil {
+		return err
+	}
+	if len(result.Implicit) > 0 && !quiet {
+		fmt.Fprintf(os.Stderr, "optimizer: added REQUIRED columns: %s\n", strings.Join(result.Implicit, ", "))
+	}
+
+	if outPath == "" {
+		fmt.Println(result.SQL)
+	} else if err := ioutil.WriteFile(outPath, []byte(result.SQL), 0644); err != nil {
+		return err
+	}
+
+	if lineagePath != "" {
+		lineageJSON, err := result.LineageJSON()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(lineagePath, lineageJSON, 0644); err != nil {
+			return err
+		}
+	}
+
+	if retainedPath != "" {
+		retainedJSON, err := result.RetainedJoinsJSON()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(retainedPath, retainedJSON, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateTemplate(templatePath, schemaPaths string) error {
+	schema, err := optimizer.LoadSchema(strings.Split(schemaPaths, ",")...)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return err
+	}
+	return optimizer.Validate(string(data), schema)
+}
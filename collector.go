@@ -0,0 +1,110 @@
+package optimizer
+
+import (
+	"github.com/xwb1989/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// collectColumns returns every column an expression reads from, together
+// with the table alias qualifying each of them. Unqualified columns are
+// reported with an empty alias. The expression is walked generically, so
+// new node types of the parser are covered without a case of their own.
+//
+// Subqueries, whether scalar, EXISTS or IN, are descended into, but only
+// their correlated references are reported: columns qualified with an
+// alias of the subquery's own FROM clause, and unqualified columns of a
+// subquery that has a FROM clause, belong to the subquery and need no join
+// of the outer query.
+func collectColumns(node sqlparser.SQLNode) ([]string, []string) {
+	var c columnCollector
+	c.walk(node, nil)
+	return c.columns, c.tables
+}
+
+type columnCollector struct {
+	columns []string
+	tables  []string
+}
+
+// walk records the references of node that are not bound by local, the
+// aliases introduced by the subqueries enclosing node.
+func (c *columnCollector) walk(node sqlparser.SQLNode, local []string) {
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch node := node.(type) {
+		case *sqlparser.ColName:
+			qualifier := node.Qualifier.Name.String()
+			if slices.Contains(local, qualifier) || (qualifier == "" && len(local) > 0) {
+				return false, nil
+			}
+			c.columns = append(c.columns, node.Name.String())
+			c.tables = append(c.tables, qualifier)
+		case *sqlparser.StarExpr:
+			// COUNT(o.*) reads no column by name but still needs o, it is
+			// reported as the column *
+			qualifier := node.TableName.Name.String()
+			if qualifier != "" && !slices.Contains(local, qualifier) {
+				c.columns = append(c.columns, "*")
+				c.tables = append(c.tables, qualifier)
+			}
+		case *sqlparser.Subquery:
+			inner := append(append([]string(nil), local...), scopeAliases(node.Select)...)
+			c.walk(node.Select, inner)
+			return false, nil
+		}
+		return true, nil
+	}, node)
+}
+
+// scopeAliases returns the names a statement's FROM clause makes visible
+// to its expressions: the alias of every table, or its name when it has
+// none.
+func scopeAliases(stmt sqlparser.SelectStatement) []string {
+	switch stmt := stmt.(type) {
+	case *sqlparser.Select:
+		var aliases []string
+		for _, tableExpr := range stmt.From {
+			aliases = append(aliases, tableExprAliases(tableExpr)...)
+		}
+		return aliases
+	case *sqlparser.Union:
+		return append(scopeAliases(stmt.Left), scopeAliases(stmt.Right)...)
+	case *sqlparser.ParenSelect:
+		return scopeAliases(stmt.Select)
+	}
+	return nil
+}
+
+func tableExprAliases(tableExpr sqlparser.TableExpr) []string {
+	switch t := tableExpr.(type) {
+	case *sqlparser.AliasedTableExpr:
+		if !t.As.IsEmpty() {
+			return []string{t.As.String()}
+		}
+		if name, ok := t.Expr.(sqlparser.TableName); ok {
+			return []string{name.Name.String()}
+		}
+	case *sqlparser.JoinTableExpr:
+		return append(tableExprAliases(t.LeftExpr), tableExprAliases(t.RightExpr)...)
+	case *sqlparser.ParenTableExpr:
+		var aliases []string
+		for _, inner := range t.Exprs {
+			aliases = append(aliases, tableExprAliases(inner)...)
+		}
+		return aliases
+	}
+	return nil
+}
+
+// columnsOf returns the names of the columns the nodes read through alias.
+func columnsOf(alias string, nodes ...sqlparser.SQLNode) []string {
+	var names []string
+	for _, node := range nodes {
+		columns, tables := collectColumns(node)
+		for i := range columns {
+			if tables[i] == alias {
+				names = append(names, columns[i])
+			}
+		}
+	}
+	return cleanList(names)
+}
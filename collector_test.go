@@ -0,0 +1,63 @@
+package optimizer
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// TestCollectColumnsCorpus runs every case of testdata/expressions.txt
+// through collectColumns.
+func TestCollectColumnsCorpus(t *testing.T) {
+	file, err := os.Open("testdata/expressions.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	cases := 0
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		expr, want, ok := strings.Cut(text, " => ")
+		if !ok {
+			t.Errorf("line %d: no => in %q", line, text)
+			continue
+		}
+		cases++
+
+		statement, err := sqlparser.Parse("select " + expr + " from t")
+		if err != nil {
+			t.Errorf("line %d: %s: %v", line, expr, err)
+			continue
+		}
+		columns, tables := collectColumns(statement.(*sqlparser.Select).SelectExprs[0].(*sqlparser.AliasedExpr).Expr)
+		var refs []string
+		for i := range columns {
+			ref := columns[i]
+			if tables[i] != "" {
+				ref = tables[i] + "." + ref
+			}
+			refs = append(refs, ref)
+		}
+		got := strings.Join(refs, ", ")
+		if got == "" {
+			got = "-"
+		}
+		if got != want {
+			t.Errorf("line %d: %s => %s, want %s", line, expr, got, want)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if cases == 0 {
+		t.Fatal("testdata/expressions.txt has no cases")
+	}
+}
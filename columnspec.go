@@ -0,0 +1,154 @@
+package optimizer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Column types understood by the catalog.
+const (
+	TypeInteger = "INTEGER"
+	TypeDate    = "DATE"
+)
+
+// ColumnSpec is the structured form of a column description written in
+// the catalog mini-language:
+//
+//	Section:order:Subsection:order -> Label[:TYPE][:REQUIRED][:['value', ...]][#DEFAULT]
+//
+// for example
+//
+//	Order details:1:Order information:1 -> Order ID:INTEGER:REQUIRED
+type ColumnSpec struct {
+	Section         string   `json:"section"`
+	SectionOrder    int      `json:"section_order"`
+	Subsection      string   `json:"subsection"`
+	SubsectionOrder int      `json:"subsection_order"`
+	Label           string   `json:"label"`
+	Type            string   `json:"type,omitempty"`
+	Required        bool     `json:"required,omitempty"`
+	Enum            []string `json:"enum,omitempty"`
+	Default         bool     `json:"default,omitempty"`
+}
+
+// ParseColumnSpec parses one column description of the mini-language.
+func ParseColumnSpec(text string) (ColumnSpec, error) {
+	var spec ColumnSpec
+	fail := func(format string, args ...interface{}) (ColumnSpec, error) {
+		return ColumnSpec{}, &ColumnSpecError{Spec: text, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	head, body, ok := strings.Cut(text, " -> ")
+	if !ok {
+		return fail("missing \" -> \" between the section and the label")
+	}
+
+	parts := strings.Split(head, ":")
+	if len(parts) != 4 {
+		return fail("section part must be Section:order:Subsection:order, got %q", head)
+	}
+	spec.Section = strings.TrimSpace(parts[0])
+	spec.Subsection = strings.TrimSpace(parts[2])
+	if spec.Section == "" || spec.Subsection == "" {
+		return fail("section and subsection must not be empty")
+	}
+	var err error
+	if spec.SectionOrder, err = parseSpecOrder(parts[1]); err != nil {
+		return fail("section order %q: %v", parts[1], err)
+	}
+	if spec.SubsectionOrder, err = parseSpecOrder(parts[3]); err != nil {
+		return fail("subsection order %q: %v", parts[3], err)
+	}
+
+	if marker := strings.LastIndex(body, "#"); marker != -1 {
+		if body[marker+1:] != FlagDefault {
+			return fail("unknown marker %q", body[marker:])
+		}
+		spec.Default = true
+		body = body[:marker]
+	}
+
+	if open := strings.Index(body, ":["); open != -1 {
+		if !strings.HasSuffix(body, "]") {
+			return fail("enum values must end with \"]\"")
+		}
+		spec.Enum, err = parseSpecEnum(body[open+2 : len(body)-1])
+		if err != nil {
+			return fail("enum values: %v", err)
+		}
+		body = body[:open]
+	}
+
+	modifiers := strings.Split(body, ":")
+	spec.Label = strings.TrimSpace(modifiers[0])
+	if spec.Label == "" {
+		return fail("label must not be empty")
+	}
+	for _, modifier := range modifiers[1:] {
+		switch modifier {
+		case TypeInteger, TypeDate:
+			if spec.Type != "" {
+				return fail("more than one type given")
+			}
+			spec.Type = modifier
+		case FlagRequired:
+			spec.Required = true
+		default:
+			return fail("unknown modifier %q", modifier)
+		}
+	}
+	return spec, nil
+}
+
+func parseSpecOrder(text string) (int, error) {
+	order, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil {
+		return 0, fmt.Errorf("not a number")
+	}
+	if order < 1 {
+		return 0, fmt.Errorf("must be 1 or greater")
+	}
+	return order, nil
+}
+
+// parseSpecEnum splits the inside of an enum list such as
+// 'Issued','Pending', 'Reissue pending' into its values.
+func parseSpecEnum(text string) ([]string, error) {
+	var values []string
+	for _, item := range strings.Split(text, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) < 2 || item[0] != '\'' || item[len(item)-1] != '\'' {
+			return nil, fmt.Errorf("value %q is not quoted with single quotes", item)
+		}
+		value := item[1 : len(item)-1]
+		if value == "" {
+			return nil, fmt.Errorf("empty value")
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// String formats the spec back into the mini-language.
+func (s ColumnSpec) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:%d:%s:%d -> %s", s.Section, s.SectionOrder, s.Subsection, s.SubsectionOrder, s.Label)
+	if s.Type != "" {
+		b.WriteString(":" + s.Type)
+	}
+	if s.Required {
+		b.WriteString(":" + FlagRequired)
+	}
+	if len(s.Enum) > 0 {
+		quoted := make([]string, len(s.Enum))
+		for i, value := range s.Enum {
+			quoted[i] = "'" + value + "'"
+		}
+		b.WriteString(":[" + strings.Join(quoted, ",") + "]")
+	}
+	if s.Default {
+		b.WriteString("#" + FlagDefault)
+	}
+	return b.String()
+}
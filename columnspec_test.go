@@ -0,0 +1,69 @@
+package optimizer
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseColumnSpec(t *testing.T) {
+	text := "Order details:1:Order information:2 -> Order status:['Issued', 'Reissue pending']#DEFAULT"
+	want := ColumnSpec{
+		Section:         "Order details",
+		SectionOrder:    1,
+		Subsection:      "Order information",
+		SubsectionOrder: 2,
+		Label:           "Order status",
+		Enum:            []string{"Issued", "Reissue pending"},
+		Default:         true,
+	}
+	spec, err := ParseColumnSpec(text)
+	if err != nil {
+		t.Fatalf("ParseColumnSpec: %v", err)
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("ParseColumnSpec = %+v, want %+v", spec, want)
+	}
+}
+
+func TestColumnSpecsOfCatalogRoundTrip(t *testing.T) {
+	for _, spec := range DefaultCatalog().ColumnSpecs() {
+		parsed, err := ParseColumnSpec(spec.String())
+		if err != nil {
+			t.Errorf("ParseColumnSpec(%q): %v", spec.String(), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, spec) {
+			t.Errorf("ParseColumnSpec(%q) = %+v, want %+v", spec.String(), parsed, spec)
+		}
+	}
+}
+
+func TestParseColumnSpecErrors(t *testing.T) {
+	for _, test := range []struct {
+		text   string
+		reason string
+	}{
+		{"Order details:1:Order information:1 Order ID", `missing " -> "`},
+		{"Order details:1:Order information -> Order ID", "section part must be"},
+		{"Order details:x:Order information:1 -> Order ID", `section order "x": not a number`},
+		{"Order details:1:Order information:0 -> Order ID", `subsection order "0": must be 1 or greater`},
+		{"Order details:1:Order information:1 -> Order ID:BIGINT", `unknown modifier "BIGINT"`},
+		{"Order details:1:Order information:1 -> Order ID:INTEGER:DATE", "more than one type given"},
+		{"Order details:1:Order information:1 -> Order status:['Issued', Pending]", `value "Pending" is not quoted`},
+		{"Order details:1:Order information:1 -> Order status:['Issued'", `enum values must end with "]"`},
+		{"Order details:1:Order information:1 -> Order ID#HIDDEN", `unknown marker "#HIDDEN"`},
+		{"Order details:1:Order information:1 -> :INTEGER", "label must not be empty"},
+	} {
+		_, err := ParseColumnSpec(test.text)
+		var specErr *ColumnSpecError
+		if !errors.As(err, &specErr) {
+			t.Errorf("ParseColumnSpec(%q) = %v, want a ColumnSpecError", test.text, err)
+			continue
+		}
+		if specErr.Spec != test.text || !strings.Contains(specErr.Reason, test.reason) {
+			t.Errorf("ParseColumnSpec(%q) = %v, want reason %q", test.text, err, test.reason)
+		}
+	}
+}
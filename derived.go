@@ -0,0 +1,202 @@
+package optimizer
+
+import (
+	"github.com/xwb1989/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// DerivedTable describes a subquery of the FROM clause. It is a scope of
+// its own: the outer query only sees it through Alias and the Columns of
+// its select list, whatever tables it reads internally.
+type DerivedTable struct {
+	Alias string
+	// Columns are the names of the select list, the alias of an
+	// expression or the name of a plain column. A * is kept as is, as the
+	// columns it expands to are not known.
+	Columns []string
+	// Tables are the tables read by the subquery, including those of
+	// derived tables nested in it.
+	Tables []string
+
+	sel *sqlparser.Select
+}
+
+func newDerivedTable(alias string, subquery *sqlparser.Subquery) (*DerivedTable, error) {
+	nestedSelect, ok := subquery.Select.(*sqlparser.Select)
+	if !ok {
+		return nil, &UnsupportedFromError{Expr: sqlparser.String(subquery), Reason: "derived table is not a plain SELECT"}
+	}
+
+	derived := &DerivedTable{Alias: alias, Columns: selectNames(nestedSelect.SelectExprs), sel: nestedSelect}
+	for _, tableExpr := range nestedSelect.From {
+		tables, err := innerTables(tableExpr)
+		if err != nil {
+			return nil, err
+		}
+		derived.Tables = append(derived.Tables, tables...)
+	}
+	derived.Tables = cleanList(derived.Tables)
+	return derived, nil
+}
+
+// innerTables returns the names of the tables a FROM item of a derived
+// table reads from.
+func innerTables(tableExpr sqlparser.TableExpr) ([]string, error) {
+	switch t := tableExpr.(type) {
+	case *sqlparser.AliasedTableExpr:
+		switch expr := t.Expr.(type) {
+		case sqlparser.TableName:
+			return []string{sqlparser.String(expr)}, nil
+		case *sqlparser.Subquery:
+			nested, err := newDerivedTable(t.As.String(), expr)
+			if err != nil {
+				return nil, err
+			}
+			return nested.Tables, nil
+		}
+	case *sqlparser.JoinTableExpr:
+		left, err := innerTables(t.LeftExpr)
+		if err != nil {
+			return nil, err
+		}
+		right, err := innerTables(t.RightExpr)
+		if err != nil {
+			return nil, err
+		}
+		return append(left, right...), nil
+	case *sqlparser.ParenTableExpr:
+		var tables []string
+		for _, inner := range t.Exprs {
+			innerTabs, err := innerTables(inner)
+			if err != nil {
+				return nil, err
+			}
+			tables = append(tables, innerTabs...)
+		}
+		return tables, nil
+	}
+	return nil, nil
+}
+
+// prune narrows the subquery down to the columns the outer query reads
+// from it and drops the joins inside it nothing depends on any more. It
+// returns the joins it keeps only because dropping them could change the
+// rows of the subquery.
+func (d *DerivedTable) prune(required []string, declared map[string]JoinInfo, schema *Schema) ([]RetainedJoin, error) {
+	retained, err := pruneSelect(d.sel, d.Alias, required, declared, schema)
+	if err != nil {
+		return nil, err
+	}
+	d.Columns = selectNames(d.sel.SelectExprs)
+	return retained, nil
+}
+
+// pruneSelect keeps the select expressions of sel whose names are listed
+// in required, or all of them when required has a *, and then prunes its
+// FROM clause. A DISTINCT select list is left alone, as every column of it
+// takes part in removing duplicates.
+func pruneSelect(sel *sqlparser.Select, alias string, required []string, declared map[string]JoinInfo, schema *Schema) ([]RetainedJoin, error) {
+	if sel.Distinct == "" && !slices.Contains(required, "*") && !slices.Contains(selectNames(sel.SelectExprs), "*") {
+		// GROUP BY, HAVING and ORDER BY may refer to the select list by
+		// its names
+		required = append(required, columnsOf("", sel.GroupBy, sel.Having, sel.OrderBy)...)
+
+		var kept sqlparser.SelectExprs
+		dropped := make(map[string]sqlparser.Expr)
+		for _, selExpr := range sel.SelectExprs {
+			if slices.Contains(required, selectName(selExpr)) {
+				kept = append(kept, selExpr)
+			} else if expr, ok := selExpr.(*sqlparser.AliasedExpr); ok && !expr.As.IsEmpty() {
+				dropped[expr.As.String()] = expr.Expr
+			}
+		}
+		if len(kept) == 0 {
+			// a select list cannot be empty, the first column is as
+			// cheap as any other
+			kept = sel.SelectExprs[:1]
+		}
+		// positions such as GROUP BY 2 would point elsewhere in the
+		// pruned list
+		inlineSelectRefs(sel, dropped)
+		sel.SelectExprs = kept
+	}
+	return pruneFrom(sel, alias, declared, schema)
+}
+
+// pruneFrom drops the joins of sel that nothing in it needs, with the same
+// analysis as the template's own query, and prunes the derived tables of
+// the joins it keeps. With a schema the unqualified columns of sel are
+// resolved first. A FROM clause with columns that still cannot be
+// attributed to one table, or read by an unqualified *, is left as it is,
+// as the joins they need are not known. alias is the name of the derived
+// table sel is the subquery of.
+func pruneFrom(sel *sqlparser.Select, alias string, declared map[string]JoinInfo, schema *Schema) ([]RetainedJoin, error) {
+	if schema != nil {
+		if err := resolveColumns(sel, schema); err != nil {
+			return nil, err
+		}
+	}
+	from, _, err := newFromJoins(sel, declared, schema)
+	if err != nil {
+		return nil, err
+	}
+	var parts []sqlparser.SQLNode
+	for _, selExpr := range sel.SelectExprs {
+		if star, ok := selExpr.(*sqlparser.StarExpr); ok && star.TableName.IsEmpty() {
+			return nil, nil
+		}
+		parts = append(parts, selExpr)
+	}
+	if len(from.joins) > 0 && len(unqualifiedColumns(sel)) > 0 {
+		return nil, nil
+	}
+	return from.prune(parts, alias, schema)
+}
+
+// aggregates reports whether sel computes its rows from groups of rows:
+// with GROUP BY, DISTINCT or an aggregate function in its select list or
+// HAVING.
+func aggregates(sel *sqlparser.Select) bool {
+	if sel.GroupBy != nil || sel.Distinct != "" {
+		return true
+	}
+	found := false
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch node := node.(type) {
+		case *sqlparser.FuncExpr:
+			found = found || node.IsAggregate()
+		case *sqlparser.GroupConcatExpr:
+			found = true
+		case *sqlparser.Subquery:
+			return false, nil
+		}
+		return !found, nil
+	}, sel.SelectExprs, sel.Having)
+	return found
+}
+
+// selectName returns the name a select expression is visible under: its
+// alias, the name of a plain column or its text.
+func selectName(selExpr sqlparser.SelectExpr) string {
+	switch expr := selExpr.(type) {
+	case *sqlparser.StarExpr:
+		return "*"
+	case *sqlparser.AliasedExpr:
+		if !expr.As.IsEmpty() {
+			return expr.As.String()
+		}
+		if colname, ok := expr.Expr.(*sqlparser.ColName); ok {
+			return colname.Name.String()
+		}
+		return sqlparser.String(expr.Expr)
+	}
+	return sqlparser.String(selExpr)
+}
+
+func selectNames(selectExprs sqlparser.SelectExprs) []string {
+	var names []string
+	for _, selExpr := range selectExprs {
+		names = append(names, selectName(selExpr))
+	}
+	return names
+}
@@ -0,0 +1,178 @@
+package optimizer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+const paymentTemplate = `SELECT o.id AS order_id, s.total AS total, s.rid AS rid
+FROM orders o
+LEFT JOIN (SELECT p.order_id, SUM(p.amount) total, MAX(r.id) rid FROM payment p LEFT JOIN refund r ON r.payment_id = p.id GROUP BY p.order_id) s ON s.order_id = o.id`
+
+func TestPruneKeepsJoinsOfAggregatingDerivedTable(t *testing.T) {
+	result, err := Optimize(paymentTemplate, []string{"total"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if !strings.Contains(result.SQL, "refund") {
+		t.Errorf("refund was dropped from an aggregating derived table:\n%s", result.SQL)
+	}
+	if strings.Contains(result.SQL, "rid") {
+		t.Errorf("unread select expression rid was kept:\n%s", result.SQL)
+	}
+}
+
+func TestPruneDropsUnreadJoinsOfDerivedTable(t *testing.T) {
+	template := `SELECT o.id AS order_id, s.amount AS amount
+FROM orders o
+LEFT JOIN (SELECT p.order_id, p.amount, r.id AS rid FROM payment p LEFT JOIN refund r ON r.payment_id = p.id) s ON s.order_id = o.id`
+	result, err := Optimize(template, []string{"amount"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if strings.Contains(result.SQL, "refund") {
+		t.Errorf("unread join of a derived table was kept:\n%s", result.SQL)
+	}
+}
+
+func TestPruneKeepsDeclaredOneToManyJoinOfDerivedTable(t *testing.T) {
+	template := `SELECT o.id AS order_id, s.amount AS amount
+FROM orders o
+LEFT JOIN (SELECT p.order_id, p.amount, r.id AS rid FROM payment p LEFT JOIN refund r ON r.payment_id = p.id) s ON s.order_id = o.id`
+	joins := map[string]JoinInfo{"r": {Cardinality: CardinalityOneToMany}}
+	result, err := Optimize(template, []string{"amount"}, Options{Joins: joins})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if !strings.Contains(result.SQL, "refund") {
+		t.Errorf("one-to-many join of a derived table was dropped:\n%s", result.SQL)
+	}
+	if len(result.RetainedJoins) != 1 || result.RetainedJoins[0].Alias != "r" || result.RetainedJoins[0].Derived != "s" {
+		t.Errorf("RetainedJoins = %+v, want r in derived table s", result.RetainedJoins)
+	}
+}
+
+func TestPruneDropsDeclaredManyToOneJoinOfAggregatingDerivedTable(t *testing.T) {
+	joins := map[string]JoinInfo{"r": {Cardinality: CardinalityManyToOne}}
+	result, err := Optimize(paymentTemplate, []string{"total"}, Options{Joins: joins})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if strings.Contains(result.SQL, "refund") {
+		t.Errorf("many-to-one join of an aggregating derived table was kept:\n%s", result.SQL)
+	}
+	if len(result.RetainedJoins) != 0 {
+		t.Errorf("RetainedJoins = %+v, want none", result.RetainedJoins)
+	}
+}
+
+func TestPruneDerivedTableJoinsLikeTheQuery(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		derived       string
+		kept, dropped []string
+	}{
+		{
+			name:    "using",
+			derived: `SELECT p.order_id, p.amount, c.code FROM payment p LEFT JOIN currency c USING (currency_id)`,
+			dropped: []string{"currency"},
+		},
+		{
+			name:    "group",
+			derived: `SELECT p.order_id, p.amount, n.body FROM payment p LEFT JOIN (refund r JOIN note n ON n.refund_id = r.id) ON r.payment_id = p.id`,
+			dropped: []string{"refund", "note"},
+		},
+		{
+			name:    "comma",
+			derived: `SELECT p.order_id, p.amount, m.name FROM payment p, method m, bank b WHERE m.id = p.method_id AND b.id = p.bank_id`,
+			kept:    []string{"method as m", "bank as b", "m.id = p.method_id"},
+		},
+	} {
+		template := "SELECT o.id AS order_id, s.amount AS amount\nFROM orders o\nLEFT JOIN (" + test.derived + ") s ON s.order_id = o.id"
+		result, err := Optimize(template, []string{"amount"}, Options{})
+		if err != nil {
+			t.Fatalf("%s: Optimize: %v", test.name, err)
+		}
+		for _, want := range test.kept {
+			if !strings.Contains(result.SQL, want) {
+				t.Errorf("%s: %q was dropped:\n%s", test.name, want, result.SQL)
+			}
+		}
+		for _, unwanted := range test.dropped {
+			if strings.Contains(result.SQL, unwanted) {
+				t.Errorf("%s: %q was kept:\n%s", test.name, unwanted, result.SQL)
+			}
+		}
+	}
+}
+
+func TestPruneReportsRetainedJoinsOfDerivedTable(t *testing.T) {
+	template := `SELECT o.id AS order_id, s.amount AS amount
+FROM orders o
+LEFT JOIN (SELECT p.order_id, p.amount, m.name FROM payment p JOIN method m ON m.id = p.method_id) s ON s.order_id = o.id`
+	result, err := Optimize(template, []string{"amount"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	want := RetainedJoin{Alias: "m", Derived: "s", JoinType: "join", Reason: "inner join drops the rows without a match"}
+	if len(result.RetainedJoins) != 1 || result.RetainedJoins[0] != want {
+		t.Errorf("RetainedJoins = %+v, want %+v", result.RetainedJoins, want)
+	}
+}
+
+func TestPruneFailsOnJoinCycleInDerivedTable(t *testing.T) {
+	template := `SELECT o.id AS order_id, s.amount AS amount
+FROM orders o
+LEFT JOIN (SELECT p.order_id, p.amount FROM payment p LEFT JOIN refund r ON r.id = n.refund_id LEFT JOIN note n ON n.id = r.note_id) s ON s.order_id = o.id`
+	_, err := Optimize(template, []string{"amount"}, Options{})
+	var cycleErr *JoinCycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("Optimize = %v, want a JoinCycleError", err)
+	}
+}
+
+func TestPruneInlinesPositionalReferencesOfDerivedTable(t *testing.T) {
+	template := `SELECT o.id AS order_id, x.total AS total
+FROM orders o
+LEFT JOIN (SELECT p.order_id, p.status, SUM(p.amount) total FROM pay p GROUP BY 1, 2 ORDER BY 2) x ON x.order_id = o.id`
+	result, err := Optimize(template, []string{"total"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	want := "(select p.order_id, SUM(p.amount) as total from pay as p group by p.order_id, p.`status` order by p.`status` asc)"
+	if !strings.Contains(result.SQL, want) {
+		t.Errorf("optimized query lacks %s:\n%s", want, result.SQL)
+	}
+}
+
+func TestPruneDerivedTableTheJoinsStartFrom(t *testing.T) {
+	template := `SELECT s.total AS total, s.cnt AS cnt, c.name AS customer
+FROM (SELECT p.order_id, SUM(p.amount) total, COUNT(*) cnt FROM payment p GROUP BY p.order_id) s
+LEFT JOIN customer c ON c.order_id = s.order_id`
+	result, err := Optimize(template, []string{"total"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	want := "from (select SUM(p.amount) as total from payment as p group by p.order_id) as s"
+	if strings.Contains(result.SQL, "customer") {
+		t.Errorf("unread join was kept:\n%s", result.SQL)
+	}
+	if !strings.Contains(result.SQL, want) {
+		t.Errorf("optimized query lacks %q:\n%s", want, result.SQL)
+	}
+	if len(result.Lineage) != 1 || !slices.Equal(result.Lineage[0].Tables, []string{"payment"}) {
+		t.Errorf("Lineage = %+v, want total read from payment", result.Lineage)
+	}
+
+	result, err = Optimize(template, []string{"total", "customer"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	want = "from (select p.order_id, SUM(p.amount) as total from payment as p group by p.order_id) as s"
+	if !strings.Contains(result.SQL, want) || !strings.Contains(result.SQL, "left join customer as c on c.order_id = s.order_id") {
+		t.Errorf("optimized query lacks %q or the join of customer:\n%s", want, result.SQL)
+	}
+}
@@ -0,0 +1,292 @@
+package optimizer
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// ParseError is returned when the template is not valid SQL. Line and
+// Column are 1-based and point into the template as it was passed in,
+// before any placeholder preprocessing.
+type ParseError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("template:%d:%d: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// NotSelectError is returned when the template's statement is something
+// other than a plain SELECT, for example a UNION or an INSERT.
+type NotSelectError struct {
+	Kind string
+}
+
+func (e *NotSelectError) Error() string {
+	return fmt.Sprintf("template statement is %s, not SELECT", e.Kind)
+}
+
+// UnsupportedFromError is returned when the FROM clause contains a table
+// expression the optimizer does not know how to walk.
+type UnsupportedFromError struct {
+	Expr   string
+	Reason string
+}
+
+func (e *UnsupportedFromError) Error() string {
+	return fmt.Sprintf("unsupported FROM expression %q: %s", e.Expr, e.Reason)
+}
+
+// ColumnIndexError is returned when a selection refers to a column index
+// that is not in the catalog.
+type ColumnIndexError struct {
+	Index int
+	Size  int
+}
+
+func (e *ColumnIndexError) Error() string {
+	return fmt.Sprintf("unknown column index %d: catalog has columns 0 to %d", e.Index, e.Size-1)
+}
+
+// InvalidRangeError is returned when an index range ends before it
+// starts.
+type InvalidRangeError struct {
+	Start int
+	End   int
+}
+
+func (e *InvalidRangeError) Error() string {
+	return fmt.Sprintf("invalid column range %d-%d: start is after end", e.Start, e.End)
+}
+
+// UnknownAliasError is returned when a selection names an alias that is
+// not in the catalog.
+type UnknownAliasError struct {
+	Alias string
+}
+
+func (e *UnknownAliasError) Error() string {
+	return fmt.Sprintf("unknown column alias %q: not in the catalog", e.Alias)
+}
+
+// UnknownSectionError is returned when a selection names a section or
+// subsection that has no entries in the catalog.
+type UnknownSectionError struct {
+	Item PresetItem
+}
+
+func (e *UnknownSectionError) Error() string {
+	return fmt.Sprintf("unknown %s: not in the catalog", e.Item)
+}
+
+// UnknownPresetError is returned when a selection names a preset that does
+// not exist.
+type UnknownPresetError struct {
+	Name string
+}
+
+func (e *UnknownPresetError) Error() string {
+	return fmt.Sprintf("unknown preset %q", e.Name)
+}
+
+// CatalogError is returned when a catalog file is malformed. Entry is the
+// 0-based position of the offending column, or -1 when the problem is not
+// tied to a single column.
+type CatalogError struct {
+	Entry  int
+	Alias  string
+	Reason string
+}
+
+func (e *CatalogError) Error() string {
+	switch {
+	case e.Entry < 0:
+		return fmt.Sprintf("catalog: %s", e.Reason)
+	case e.Alias != "":
+		return fmt.Sprintf("catalog entry %d (%s): %s", e.Entry, e.Alias, e.Reason)
+	}
+	return fmt.Sprintf("catalog entry %d: %s", e.Entry, e.Reason)
+}
+
+// ColumnSpecError is returned when a column description in the catalog
+// mini-language is malformed.
+type ColumnSpecError struct {
+	Spec   string
+	Reason string
+}
+
+func (e *ColumnSpecError) Error() string {
+	return fmt.Sprintf("column spec %q: %s", e.Spec, e.Reason)
+}
+
+// UnknownColumnError is returned when a selected alias is not produced by
+// any select expression of the template.
+type UnknownColumnError struct {
+	Alias string
+}
+
+func (e *UnknownColumnError) Error() string {
+	return fmt.Sprintf("unknown column %q: template has no select expression with this alias", e.Alias)
+}
+
+// JoinError is returned when a declaration about a join, in the catalog,
+// a template annotation or a sidecar file, is malformed.
+type JoinError struct {
+	Alias  string
+	Reason string
+}
+
+func (e *JoinError) Error() string {
+	return fmt.Sprintf("join %q: %s", e.Alias, e.Reason)
+}
+
+// JoinCycleError is returned when joins of the template depend on each
+// other in a cycle, so that no order of them is valid. Aliases lists the
+// cycle, starting and ending with the same join.
+type JoinCycleError struct {
+	Aliases []string
+}
+
+func (e *JoinCycleError) Error() string {
+	return fmt.Sprintf("join dependency cycle: %s", strings.Join(e.Aliases, " -> "))
+}
+
+// SchemaError is returned when a schema definition cannot be read. Table
+// is empty when the problem is not tied to a single table.
+type SchemaError struct {
+	Table  string
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Table != "" {
+		return fmt.Sprintf("schema: table %q: %s", e.Table, e.Reason)
+	}
+	return fmt.Sprintf("schema: %s", e.Reason)
+}
+
+// AmbiguousColumnError is returned when an unqualified column of the
+// template is a column of more than one of its tables, by the schema.
+// Tables lists their aliases.
+type AmbiguousColumnError struct {
+	Column string
+	Tables []string
+}
+
+func (e *AmbiguousColumnError) Error() string {
+	return fmt.Sprintf("column %q is ambiguous: tables %s have it", e.Column, strings.Join(e.Tables, ", "))
+}
+
+// Problem is one thing Validate found wrong with a template. Line and
+// Column are 1-based and point into the template as it was passed in; they
+// are 0 when the problem could not be located.
+type Problem struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("template: %s", p.Message)
+	}
+	return fmt.Sprintf("template:%d:%d: %s", p.Line, p.Column, p.Message)
+}
+
+// ValidationError is returned by Validate with every problem it found, in
+// template order.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		lines[i] = problem.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+var positionPattern = regexp.MustCompile(`at position (\d+)(?: near '(.*)')?`)
+
+// newParseError converts an error from sqlparser into a ParseError. The
+// parser reports the byte position after the token it stopped at, in the
+// preprocessed statement; the error is placed at the start of that token
+// and mapped back onto the original template.
+func newParseError(template string, err error) *ParseError {
+	offset := 0
+	if match := positionPattern.FindStringSubmatch(err.Error()); match != nil {
+		position, _ := strconv.Atoi(match[1])
+		offset = position - 1
+		processed := strings.ToLower(preprocessing(template))
+		if near := strings.ToLower(match[2]); near != "" && offset <= len(processed) {
+			if start := strings.LastIndex(processed[:offset], near); start != -1 {
+				offset = start
+			}
+		}
+	}
+	line, column := templatePosition(template, offset)
+	return &ParseError{
+		Line:   line,
+		Column: column,
+		Err:    err,
+	}
+}
+
+// templatePosition returns the 1-based line and column of the byte offset
+// into preprocessing(template). Preprocessing never adds or removes line
+// breaks, so only the column has to be mapped back onto the original line.
+func templatePosition(template string, offset int) (int, int) {
+	processed := preprocessing(template)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(processed) {
+		offset = len(processed)
+	}
+
+	line := strings.Count(processed[:offset], "\n") + 1
+	column := offset - (strings.LastIndex(processed[:offset], "\n") + 1)
+
+	lines := strings.Split(template, "\n")
+	if line > len(lines) {
+		return line, column + 1
+	}
+	original := lines[line-1]
+	for i := 0; i <= len(original); i++ {
+		if len(preprocessing(original[:i])) >= column {
+			return line, i + 1
+		}
+	}
+	return line, len(original) + 1
+}
+
+// statementKind names a parsed statement for error messages.
+func statementKind(statement sqlparser.Statement) string {
+	switch statement.(type) {
+	case *sqlparser.Union:
+		return "UNION"
+	case *sqlparser.ParenSelect:
+		return "parenthesized SELECT"
+	case *sqlparser.Insert:
+		return "INSERT"
+	case *sqlparser.Update:
+		return "UPDATE"
+	case *sqlparser.Delete:
+		return "DELETE"
+	case *sqlparser.DDL, *sqlparser.DBDDL:
+		return "DDL"
+	default:
+		return strings.TrimPrefix(fmt.Sprintf("%T", statement), "*sqlparser.")
+	}
+}
@@ -0,0 +1,27 @@
+package optimizer
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseErrorPointsAtToken(t *testing.T) {
+	for _, test := range []struct {
+		template     string
+		line, column int
+	}{
+		{"SELECT o.id AS a,\nFROM orders o", 2, 1},
+		{"SELECT o.id AS a\nFROM orders o\nWHERE o.x = `a b` oops", 3, 19},
+		{"SELECT @account_id AS a,\nFROM orders o", 2, 1},
+	} {
+		_, err := Optimize(test.template, []string{"a"}, Options{})
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Optimize(%q) = %v, want a ParseError", test.template, err)
+			continue
+		}
+		if parseErr.Line != test.line || parseErr.Column != test.column {
+			t.Errorf("Optimize(%q) fails at %d:%d, want %d:%d", test.template, parseErr.Line, parseErr.Column, test.line, test.column)
+		}
+	}
+}
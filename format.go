@@ -0,0 +1,64 @@
+package optimizer
+
+import (
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// formatQuery serializes a select with the parser's formatter. The outer
+// query is laid out with every select expression, join and clause on a
+// line of its own; subqueries are formatted as the parser does.
+func formatQuery(sel *sqlparser.Select) string {
+	// the joins of comma separated items are indented like the items
+	chain := make(map[*sqlparser.JoinTableExpr]string)
+	for i, tableExpr := range sel.From {
+		for join, ok := tableExpr.(*sqlparser.JoinTableExpr); ok; join, ok = join.LeftExpr.(*sqlparser.JoinTableExpr) {
+			chain[join] = "\n"
+			if i > 0 {
+				chain[join] = "\n\t"
+			}
+		}
+	}
+
+	buf := sqlparser.NewTrackedBuffer(func(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+		switch node := node.(type) {
+		case *sqlparser.Select:
+			if node != sel {
+				break
+			}
+			head := sqlparser.NewTrackedBuffer(nil)
+			head.Myprintf("select %v%s%s%s", node.Comments, node.Cache, node.Distinct, node.Hints)
+			buf.Myprintf("%s", strings.TrimRight(head.String(), " "))
+			for i, selExpr := range node.SelectExprs {
+				separator := ","
+				if i == len(node.SelectExprs)-1 {
+					separator = ""
+				}
+				buf.Myprintf("\n\t%v%s", selExpr, separator)
+			}
+			buf.Myprintf("\nfrom ")
+			for i, tableExpr := range node.From {
+				if i > 0 {
+					buf.Myprintf(",\n\t")
+				}
+				buf.Myprintf("%v", tableExpr)
+			}
+			for _, clause := range clauses(node) {
+				if text := strings.TrimSpace(sqlparser.String(clause)); text != "" {
+					buf.Myprintf("\n%s", text)
+				}
+			}
+			buf.Myprintf("%s", node.Lock)
+			return
+		case *sqlparser.JoinTableExpr:
+			if separator, ok := chain[node]; ok {
+				buf.Myprintf("%v%s%s %v%v", node.LeftExpr, separator, node.Join, node.RightExpr, node.Condition)
+				return
+			}
+		}
+		node.Format(buf)
+	})
+	buf.Myprintf("%v", sel)
+	return buf.String()
+}
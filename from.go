@@ -0,0 +1,426 @@
+package optimizer
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// commaJoinStr is the join type of a table listed after a comma in a FROM
+// clause. Its condition is made of the WHERE equalities connecting it to
+// the tables listed before it.
+const commaJoinStr = ","
+
+// fromWalker collects the joins of a FROM clause in template order. Join
+// trees of any shape are walked: a join whose right side is a group of
+// joins, written in parentheses or not, brings in the group's first table,
+// and the joins inside the group depend on it. A comma separated item is
+// joined like a group, to the items listed before it.
+type fromWalker struct {
+	joins    []JoinExpression
+	declared map[string]JoinInfo
+	// conditions are the conjuncts of the WHERE clause taken as the
+	// conditions of comma joins, predicates those that have not been, and
+	// seen the aliases of the tables walked so far.
+	conditions []sqlparser.Expr
+	predicates []sqlparser.Expr
+	seen       []string
+	// scope holds the known columns of the tables, by alias.
+	scope map[string][]string
+}
+
+func newFromWalker(sel *sqlparser.Select, declared map[string]JoinInfo, schema *Schema) *fromWalker {
+	w := &fromWalker{declared: declared, scope: schema.scope(sel.From)}
+	if sel.Where != nil {
+		w.predicates = splitAnd(sel.Where.Expr)
+	}
+	return w
+}
+
+// walkItems collects the joins of comma separated FROM items, the first of
+// which brings in nothing by itself.
+func (w *fromWalker) walkItems(items sqlparser.TableExprs, parent int) error {
+	for i, item := range items {
+		itemParent := parent
+		if i > 0 {
+			if err := w.join(commaJoinStr, items[0], item, w.commaCondition(item), leftmostTable(item), parent); err != nil {
+				return err
+			}
+			itemParent = len(w.joins) - 1
+		}
+		if err := w.walk(item, itemParent); err != nil {
+			return err
+		}
+		w.seen = append(w.seen, tableExprAliases(item)...)
+	}
+	return nil
+}
+
+// walk collects the joins of tableExpr. parent is the index of the join
+// that brings in the group tableExpr is part of, or -1 at the top level.
+func (w *fromWalker) walk(tableExpr sqlparser.TableExpr, parent int) error {
+	switch t := tableExpr.(type) {
+	case *sqlparser.AliasedTableExpr:
+		return nil
+	case *sqlparser.ParenTableExpr:
+		return w.walkItems(t.Exprs, parent)
+	case *sqlparser.JoinTableExpr:
+		if err := w.walk(t.LeftExpr, parent); err != nil {
+			return err
+		}
+		on := t.Condition.On
+		if on == nil {
+			on = w.sharedColumns(t)
+		}
+		if err := w.join(t.Join, t.LeftExpr, t.RightExpr, on, t, parent); err != nil {
+			return err
+		}
+		if t.Condition.On == nil {
+			// the join is emitted as written, the references its condition
+			// stands for only serve its dependencies
+			w.joins[len(w.joins)-1].OnCondition = strings.TrimSpace(sqlparser.String(t.Condition))
+		}
+		return w.walk(t.RightExpr, len(w.joins)-1)
+	}
+	return &UnsupportedFromError{Expr: sqlparser.String(tableExpr), Reason: "unknown table expression"}
+}
+
+// join records the join of the first table of right onto the tables of
+// left.
+func (w *fromWalker) join(joinType string, left, right sqlparser.TableExpr, on sqlparser.Expr, node sqlparser.TableExpr, parent int) error {
+	// a derived table is its own scope, it is matched on its alias only
+	// and joined as the subquery it is
+	leftTable, rightTable := leftmostTable(left), leftmostTable(right)
+	var derived *DerivedTable
+	if subquery, ok := rightTable.Expr.(*sqlparser.Subquery); ok {
+		var err error
+		if derived, err = newDerivedTable(sqlparser.String(rightTable.As), subquery); err != nil {
+			return err
+		}
+	}
+	columns, tables := removeDuplicates(collectColumns(on))
+	join := JoinExpression{
+		LeftTable:           sqlparser.String(leftTable.Expr),
+		LeftTableAliasName:  sqlparser.String(leftTable.As),
+		JoinType:            joinType,
+		RightTable:          sqlparser.String(rightTable.Expr),
+		RightTableAliasName: sqlparser.String(rightTable.As),
+		Derived:             derived,
+		OnCondition:         sqlparser.String(on),
+		Tables:              tables,
+		Columns:             columns,
+		on:                  on,
+		node:                node,
+		parent:              parent,
+	}
+	join.Cardinality = w.declared[join.name()].Cardinality
+	w.joins = append(w.joins, join)
+	return nil
+}
+
+// sharedColumns returns the column references a USING or NATURAL join
+// condition stands for: each shared column of the tables on either side
+// that have it. When the columns of a table are not known it is taken to
+// have them all, and the columns a NATURAL join shares are referred to as
+// * unless the columns of every table it joins are known. It returns nil
+// for a join without a condition.
+func (w *fromWalker) sharedColumns(join *sqlparser.JoinTableExpr) sqlparser.Expr {
+	left, right := tableExprAliases(join.LeftExpr), tableExprAliases(join.RightExpr)
+	names := join.Condition.Using
+	if isNaturalJoin(join.Join) {
+		names = sqlparser.Columns{sqlparser.NewColIdent("*")}
+		if natural, known := naturalColumns(w.scope, left, right); known {
+			names = nil
+			for _, name := range natural {
+				names = append(names, sqlparser.NewColIdent(name))
+			}
+		}
+	}
+	var refs sqlparser.ValTuple
+	for _, name := range names {
+		for _, alias := range append(append([]string(nil), left...), right...) {
+			if columns, ok := w.scope[alias]; !ok || name.String() == "*" || slices.Contains(columns, name.Lowered()) {
+				refs = append(refs, &sqlparser.ColName{Name: name, Qualifier: sqlparser.TableName{Name: sqlparser.NewTableIdent(alias)}})
+			}
+		}
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	return refs
+}
+
+// isNaturalJoin reports whether a join type is one of the NATURAL joins.
+func isNaturalJoin(joinType string) bool {
+	return strings.HasPrefix(strings.ToLower(joinType), "natural")
+}
+
+// commaCondition takes the WHERE equalities between the tables of item and
+// the tables listed before it, and returns them as one condition, or nil.
+// An equality is taken by the last of the items it connects, so that a
+// comma join only ever depends on items listed before it.
+func (w *fromWalker) commaCondition(item sqlparser.TableExpr) sqlparser.Expr {
+	aliases := tableExprAliases(item)
+	var condition sqlparser.Expr
+	remaining := w.predicates[:0:0]
+	for _, predicate := range w.predicates {
+		comparison, ok := predicate.(*sqlparser.ComparisonExpr)
+		_, tables := collectColumns(predicate)
+		inItem := func(alias string) bool { return slices.Contains(aliases, alias) }
+		before := func(alias string) bool { return slices.Contains(w.seen, alias) }
+		connects := ok && comparison.Operator == sqlparser.EqualStr &&
+			slices.ContainsFunc(tables, inItem) && slices.ContainsFunc(tables, before) &&
+			!slices.ContainsFunc(tables, func(alias string) bool { return !inItem(alias) && !before(alias) })
+		if !connects {
+			remaining = append(remaining, predicate)
+			continue
+		}
+		w.conditions = append(w.conditions, predicate)
+		if condition == nil {
+			condition = predicate
+		} else {
+			condition = &sqlparser.AndExpr{Left: condition, Right: predicate}
+		}
+	}
+	w.predicates = remaining
+	return condition
+}
+
+// splitAnd returns the conjuncts of expr.
+func splitAnd(expr sqlparser.Expr) []sqlparser.Expr {
+	switch expr := expr.(type) {
+	case *sqlparser.AndExpr:
+		return append(splitAnd(expr.Left), splitAnd(expr.Right)...)
+	case *sqlparser.ParenExpr:
+		if and, ok := expr.Expr.(*sqlparser.AndExpr); ok {
+			return splitAnd(and)
+		}
+	}
+	return []sqlparser.Expr{expr}
+}
+
+// pruneWhere returns where without the conditions of comma joins listed in
+// dropped, or nil when nothing is left of it.
+func pruneWhere(where *sqlparser.Where, dropped []sqlparser.Expr) *sqlparser.Where {
+	if where == nil {
+		return nil
+	}
+	var expr sqlparser.Expr
+	for _, conjunct := range splitAnd(where.Expr) {
+		if comparison, ok := conjunct.(*sqlparser.ComparisonExpr); ok && slices.Contains(dropped, sqlparser.Expr(comparison)) {
+			continue
+		}
+		if expr == nil {
+			expr = conjunct
+		} else {
+			expr = &sqlparser.AndExpr{Left: expr, Right: conjunct}
+		}
+	}
+	if expr == nil {
+		return nil
+	}
+	return &sqlparser.Where{Type: where.Type, Expr: expr}
+}
+
+// leftmostTable returns the table a FROM item starts from.
+func leftmostTable(tableExpr sqlparser.TableExpr) *sqlparser.AliasedTableExpr {
+	switch t := tableExpr.(type) {
+	case *sqlparser.JoinTableExpr:
+		return leftmostTable(t.LeftExpr)
+	case *sqlparser.ParenTableExpr:
+		return leftmostTable(t.Exprs[0])
+	}
+	return tableExpr.(*sqlparser.AliasedTableExpr)
+}
+
+// rebuildFrom rebuilds comma separated FROM items from the joins listed in
+// order, and drops their other joins. Joins are put in that order only
+// within the chain they are written in, and comma separated items keep
+// their place, so the grouping of the template is kept; a group that is
+// left with a single table loses its parentheses.
+func rebuildFrom(items sqlparser.TableExprs, order map[sqlparser.TableExpr]int) sqlparser.TableExprs {
+	var kept sqlparser.TableExprs
+	for i, item := range items {
+		if _, ok := order[leftmostTable(item)]; ok || i == 0 {
+			kept = append(kept, rebuildTableExpr(item, order))
+		}
+	}
+	return kept
+}
+
+func rebuildTableExpr(tableExpr sqlparser.TableExpr, order map[sqlparser.TableExpr]int) sqlparser.TableExpr {
+	switch t := tableExpr.(type) {
+	case *sqlparser.ParenTableExpr:
+		t.Exprs = rebuildFrom(t.Exprs, order)
+		if table, ok := t.Exprs[0].(*sqlparser.AliasedTableExpr); ok && len(t.Exprs) == 1 {
+			return table
+		}
+		return t
+	case *sqlparser.JoinTableExpr:
+		var chain []*sqlparser.JoinTableExpr
+		base := sqlparser.TableExpr(t)
+		for join, ok := base.(*sqlparser.JoinTableExpr); ok; join, ok = base.(*sqlparser.JoinTableExpr) {
+			if _, kept := order[join]; kept {
+				chain = append(chain, join)
+			}
+			base = join.LeftExpr
+		}
+		sort.Slice(chain, func(i, j int) bool { return order[chain[i]] < order[chain[j]] })
+
+		base = rebuildTableExpr(base, order)
+		for _, join := range chain {
+			join.LeftExpr = base
+			join.RightExpr = rebuildTableExpr(join.RightExpr, order)
+			base = join
+		}
+		return base
+	}
+	return tableExpr
+}
+
+// fromJoins are the joins of the FROM clause of one SELECT, the template's
+// own query or the subquery of a derived table, and the dependencies
+// between them.
+type fromJoins struct {
+	sel      *sqlparser.Select
+	declared map[string]JoinInfo
+	joins    []JoinExpression
+	graph    *joinGraph
+	// base is the derived table the joins start from, if they start from
+	// one.
+	base *DerivedTable
+	// conditions are the WHERE equalities taken as the conditions of
+	// comma joins.
+	conditions []sqlparser.Expr
+}
+
+// newFromJoins walks the FROM clause of sel and links its joins by the
+// tables their conditions read from. It also returns the references of
+// those conditions that name neither a join nor the table the joins start
+// from, and fails with a JoinCycleError when joins depend on each other in
+// a cycle, as that leaves no valid order of them, whichever are kept.
+func newFromJoins(sel *sqlparser.Select, declared map[string]JoinInfo, schema *Schema) (*fromJoins, []string, error) {
+	walker := newFromWalker(sel, declared, schema)
+	if err := walker.walkItems(sel.From, -1); err != nil {
+		return nil, nil, err
+	}
+	f := &fromJoins{sel: sel, declared: declared, joins: walker.joins, conditions: walker.conditions}
+	first := leftmostTable(sel.From[0])
+	if subquery, ok := first.Expr.(*sqlparser.Subquery); ok {
+		var err error
+		if f.base, err = newDerivedTable(first.As.String(), subquery); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// a join depends on the joins of the tables its condition reads from,
+	// other than its own and the table the joins start from
+	graph, unresolved := newJoinGraph(f.joins)
+	for i := range f.joins {
+		for _, dependency := range graph.edges[i] {
+			f.joins[i].DependsOn = append(f.joins[i].DependsOn, f.joins[dependency].name())
+		}
+	}
+	all := make([]bool, len(f.joins))
+	for i := range all {
+		all[i] = true
+	}
+	if _, err := graph.order(all); err != nil {
+		return nil, nil, err
+	}
+	f.graph = graph
+	return f, unresolved, nil
+}
+
+// prune drops the joins that neither parts, the clauses of the select nor
+// its rows depend on, and prunes the derived tables of the kept joins to
+// what the kept parts of the select read from them. parts are the select
+// expressions that are kept, which the select list has been pruned to
+// already, derived the alias of the derived table the
+// select is the subquery of, or empty for the template's own query. It
+// returns the joins kept only for the rows.
+func (f *fromJoins) prune(parts []sqlparser.SQLNode, derived string, schema *Schema) ([]RetainedJoin, error) {
+	sel := f.sel
+	var selected []string
+	for _, part := range parts {
+		_, tables := collectColumns(part)
+		selected = append(selected, tables...)
+	}
+	for _, clause := range clauses(sel) {
+		// the WHERE equalities taken as the conditions of comma joins go
+		// with their joins, as ON conditions do
+		if clause == sel.Where {
+			clause = pruneWhere(sel.Where, f.conditions)
+		}
+		_, tables := collectColumns(clause)
+		selected = append(selected, tables...)
+	}
+
+	kept, reasons := keptJoins(f.graph, selected, f.declared, aggregates(sel))
+	var droppedConditions []sqlparser.Expr
+	for i, join := range f.joins {
+		if !kept[i] && join.JoinType == commaJoinStr && join.on != nil {
+			droppedConditions = append(droppedConditions, splitAnd(join.on)...)
+		}
+	}
+	if len(droppedConditions) > 0 {
+		sel.Where = pruneWhere(sel.Where, droppedConditions)
+	}
+	var retained []RetainedJoin
+	for i, join := range f.joins {
+		if reasons[i] != "" {
+			retained = append(retained, RetainedJoin{
+				Alias:       join.name(),
+				Derived:     derived,
+				JoinType:    join.JoinType,
+				Cardinality: join.Cardinality,
+				Reason:      reasons[i],
+			})
+		}
+	}
+
+	// the derived tables that are kept only need to compute what the kept
+	// parts of the select and the other kept joins read from them
+	keptParts := append(append([]sqlparser.SQLNode(nil), parts...), clauses(sel)...)
+	for i := range f.joins {
+		if kept[i] {
+			keptParts = append(keptParts, f.joins[i].on)
+		}
+	}
+	tables := []*DerivedTable{f.base}
+	for i := range f.joins {
+		if kept[i] {
+			tables = append(tables, f.joins[i].Derived)
+		}
+	}
+	pruned := make(map[string]string)
+	for _, table := range tables {
+		if table == nil {
+			continue
+		}
+		nested, err := table.prune(columnsOf(table.Alias, keptParts...), f.declared, schema)
+		if err != nil {
+			return nil, err
+		}
+		retained = append(retained, nested...)
+		pruned[table.Alias] = "(" + sqlparser.String(table.sel) + ")"
+	}
+	for i, join := range f.joins {
+		if text, ok := pruned[join.LeftTableAliasName]; ok {
+			f.joins[i].LeftTable = text
+		}
+		if text, ok := pruned[join.RightTableAliasName]; ok && join.Derived != nil {
+			f.joins[i].RightTable = text
+		}
+	}
+
+	keptOrder, _ := f.graph.order(kept)
+	order := make(map[sqlparser.TableExpr]int)
+	for position, index := range keptOrder {
+		order[f.joins[index].node] = position
+	}
+	sel.From = rebuildFrom(sel.From, order)
+	return retained, nil
+}
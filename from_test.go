@@ -0,0 +1,90 @@
+package optimizer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOptimizeKeepsGroupingOfJoins(t *testing.T) {
+	const (
+		group  = "SELECT a.x AS ax, b.x AS bx, c.x AS cx FROM a LEFT JOIN (b LEFT JOIN c ON c.b_id = b.id) ON b.a_id = a.id"
+		nested = "SELECT a.x AS ax, b.x AS bx, c.x AS cx FROM a LEFT JOIN b LEFT JOIN c ON c.b_id = b.id ON b.a_id = a.id"
+	)
+	for _, test := range []struct {
+		template string
+		column   string
+		from     string
+	}{
+		{group, "ax", "from a"},
+		{group, "bx", "from a\nleft join b on b.a_id = a.id"},
+		{group, "cx", "from a\nleft join (b left join c on c.b_id = b.id) on b.a_id = a.id"},
+		{nested, "ax", "from a"},
+		{nested, "bx", "from a\nleft join b on b.a_id = a.id"},
+		{nested, "cx", "from a\nleft join b left join c on c.b_id = b.id on b.a_id = a.id"},
+	} {
+		result, err := Optimize(test.template, []string{test.column}, Options{})
+		if err != nil {
+			t.Fatalf("Optimize(%q, %s): %v", test.template, test.column, err)
+		}
+		if from := result.SQL[strings.Index(result.SQL, "from"):]; from != test.from {
+			t.Errorf("Optimize(%q, %s) FROM clause:\n%s\nwant:\n%s", test.template, test.column, from, test.from)
+		}
+	}
+}
+
+func TestInnerJoinOfGroupIsKeptWithItsParent(t *testing.T) {
+	template := "SELECT a.x AS ax, b.x AS bx, c.x AS cx FROM a LEFT JOIN (b JOIN c ON c.b_id = b.id) ON b.a_id = a.id"
+
+	// the inner join only filters the rows of its group, which go with b
+	result, err := Optimize(template, []string{"ax"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if strings.Contains(result.SQL, "join") || len(result.RetainedJoins) != 0 {
+		t.Errorf("group of an unread join was kept:\n%s\n%+v", result.SQL, result.RetainedJoins)
+	}
+
+	result, err = Optimize(template, []string{"bx"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if !strings.Contains(result.SQL, "left join (b join c on c.b_id = b.id) on b.a_id = a.id") {
+		t.Errorf("inner join of a kept group was dropped:\n%s", result.SQL)
+	}
+	want := RetainedJoin{Alias: "c", JoinType: "join", Reason: "inner join drops the rows without a match"}
+	if len(result.RetainedJoins) != 1 || result.RetainedJoins[0] != want {
+		t.Errorf("RetainedJoins = %+v, want %+v", result.RetainedJoins, want)
+	}
+}
+
+func TestUsingJoinDependsOnItsPartner(t *testing.T) {
+	template := `SELECT o.id AS order_id, c.name AS customer, r.name AS region
+FROM orders o
+LEFT JOIN customer c ON c.id = o.customer_id
+LEFT JOIN region r USING (region_id)`
+
+	// without a schema either table on the left may have region_id
+	result, err := Optimize(template, []string{"region"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	want := "from orders as o\nleft join customer as c on c.id = o.customer_id\nleft join region as r using (region_id)"
+	if !strings.HasSuffix(result.SQL, want) {
+		t.Errorf("optimized query does not end with\n%s\ngot:\n%s", want, result.SQL)
+	}
+
+	schema, err := ParseSchema(`CREATE TABLE orders (id int, customer_id int, region_id int);
+CREATE TABLE customer (id int, name varchar(64));
+CREATE TABLE region (region_id int, name varchar(64));`)
+	if err != nil {
+		t.Fatalf("ParseSchema: %v", err)
+	}
+	result, err = Optimize(template, []string{"region"}, Options{Schema: schema})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	want = "from orders as o\nleft join region as r using (region_id)"
+	if !strings.HasSuffix(result.SQL, want) {
+		t.Errorf("optimized query does not end with\n%s\ngot:\n%s", want, result.SQL)
+	}
+}
@@ -0,0 +1,9 @@
+module github.com/adarsh-kn-digicert/optimizer
+
+go 1.25.0
+
+require (
+	github.com/xwb1989/sqlparser v0.0.0-20180606152119-120387863bf2
+	golang.org/x/exp v0.0.0-20260611194520-c48552f49976
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,171 @@
+package optimizer
+
+import (
+	"golang.org/x/exp/slices"
+)
+
+// joinGraph holds the dependencies between the joins of the FROM clause,
+// numbered in template order: a join depends on every join whose table
+// its condition reads from.
+type joinGraph struct {
+	joins []JoinExpression
+	edges [][]int
+	// inner holds the joins inside the group of a join that its condition
+	// reads from.
+	inner [][]int
+}
+
+// newJoinGraph links the joins by the aliases their conditions read from,
+// and the joins inside a group of joins to the join that brings it in.
+// It also returns the references that name neither a join nor the table
+// the joins start from.
+func newJoinGraph(joins []JoinExpression) (*joinGraph, []string) {
+	g := &joinGraph{joins: joins, edges: make([][]int, len(joins)), inner: make([][]int, len(joins))}
+	var unresolved []string
+	for i, join := range joins {
+		// a join inside a group of joins needs the join of the group
+		if join.parent != -1 {
+			g.edges[i] = append(g.edges[i], join.parent)
+		}
+		for _, name := range join.Tables {
+			if name == "" || name == join.RightTableAliasName || name == join.LeftTableAliasName || name == join.LeftTable {
+				continue
+			}
+			dependency := g.find(name)
+			if dependency == -1 {
+				unresolved = append(unresolved, name)
+				continue
+			}
+			// a condition may read from the group of joins it brings in:
+			// those joins depend on it, but are needed wherever it is
+			if g.within(dependency, i) {
+				g.inner[i] = append(g.inner[i], dependency)
+				continue
+			}
+			if dependency != i && !slices.Contains(g.edges[i], dependency) {
+				g.edges[i] = append(g.edges[i], dependency)
+			}
+		}
+	}
+	return g, unresolved
+}
+
+// within reports whether join is inside the group of joins brought in by
+// group, directly or through nested groups.
+func (g *joinGraph) within(join, group int) bool {
+	for parent := g.joins[join].parent; parent != -1; parent = g.joins[parent].parent {
+		if parent == group {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the join of the table an alias or table name refers to, or
+// -1. Derived tables can only be referred to by their alias.
+func (g *joinGraph) find(name string) int {
+	if name == "" {
+		return -1
+	}
+	if i := slices.IndexFunc(g.joins, func(j JoinExpression) bool { return j.RightTableAliasName == name }); i != -1 {
+		return i
+	}
+	return slices.IndexFunc(g.joins, func(j JoinExpression) bool { return j.Derived == nil && j.RightTable == name })
+}
+
+// closure marks the joins of the named tables and, transitively, all the
+// joins those depend on.
+func (g *joinGraph) closure(names []string) []bool {
+	marked := make([]bool, len(g.joins))
+	var visit func(i int)
+	visit = func(i int) {
+		if marked[i] {
+			return
+		}
+		marked[i] = true
+		for _, dependency := range g.edges[i] {
+			visit(dependency)
+		}
+		for _, inner := range g.inner[i] {
+			visit(inner)
+		}
+	}
+	for _, name := range names {
+		if i := g.find(name); i != -1 {
+			visit(i)
+		}
+	}
+	return marked
+}
+
+// order returns the marked joins so that every join comes after the joins
+// it depends on, keeping the template order wherever the dependencies
+// allow it. It fails with a JoinCycleError when joins depend on each other
+// in a cycle.
+func (g *joinGraph) order(marked []bool) ([]int, error) {
+	var ordered []int
+	emitted := make([]bool, len(g.joins))
+	ready := func(i int) bool {
+		for _, dependency := range g.edges[i] {
+			if marked[dependency] && !emitted[dependency] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for len(ordered) < countMarked(marked) {
+		next := -1
+		for i := range g.joins {
+			if marked[i] && !emitted[i] && ready(i) {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			return nil, &JoinCycleError{Aliases: g.cycle(marked, emitted)}
+		}
+		emitted[next] = true
+		ordered = append(ordered, next)
+	}
+	return ordered, nil
+}
+
+// cycle follows the dependencies among the marked joins that could not be
+// ordered until it comes back to a join, and returns the aliases along
+// the way, starting and ending with that join.
+func (g *joinGraph) cycle(marked, emitted []bool) []string {
+	// every join left has a dependency that is left as well, otherwise
+	// it could have been ordered
+	var path []int
+	i := 0
+	for !marked[i] || emitted[i] {
+		i++
+	}
+	for !slices.Contains(path, i) {
+		path = append(path, i)
+		for _, dependency := range g.edges[i] {
+			if marked[dependency] && !emitted[dependency] {
+				i = dependency
+				break
+			}
+		}
+	}
+	path = append(path[slices.Index(path, i):], i)
+
+	aliases := make([]string, len(path))
+	for k, join := range path {
+		aliases[k] = g.joins[join].name()
+	}
+	return aliases
+}
+
+func countMarked(marked []bool) int {
+	count := 0
+	for _, m := range marked {
+		if m {
+			count++
+		}
+	}
+	return count
+}
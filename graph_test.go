@@ -0,0 +1,53 @@
+package optimizer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestJoinCycleIsReported(t *testing.T) {
+	template := `SELECT o.id AS order_id, a.x AS x
+FROM orders o
+LEFT JOIN alpha a ON a.id = b.alpha_id
+LEFT JOIN beta b ON b.id = a.beta_id`
+	_, err := Optimize(template, []string{"order_id"}, Options{})
+	var cycleErr *JoinCycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("Optimize = %v, want a JoinCycleError", err)
+	}
+	if want := []string{"a", "b", "a"}; !slices.Equal(cycleErr.Aliases, want) {
+		t.Errorf("Aliases = %v, want %v", cycleErr.Aliases, want)
+	}
+}
+
+func TestJoinIsMovedBehindItsDependency(t *testing.T) {
+	template := `SELECT o.id AS order_id, a.x AS x, c.y AS y
+FROM orders o
+LEFT JOIN alpha a ON a.id = b.alpha_id
+LEFT JOIN gamma c ON c.order_id = o.id
+LEFT JOIN beta b ON b.order_id = o.id`
+	result, err := Optimize(template, []string{"x", "y"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	want := `from orders as o
+left join gamma as c on c.order_id = o.id
+left join beta as b on b.order_id = o.id
+left join alpha as a on a.id = b.alpha_id`
+	if !strings.Contains(result.SQL, want) {
+		t.Errorf("optimized query lacks\n%s\ngot:\n%s", want, result.SQL)
+	}
+	var joins []string
+	for _, join := range result.Lineage[0].JoinExpression {
+		joins = append(joins, join.name())
+	}
+	if want := []string{"b", "a"}; !slices.Equal(joins, want) {
+		t.Errorf("joins of x = %v, want %v", joins, want)
+	}
+	if dependsOn := result.Lineage[0].JoinExpression[1].DependsOn; !slices.Equal(dependsOn, []string{"b"}) {
+		t.Errorf("a depends on %v, want [b]", dependsOn)
+	}
+}
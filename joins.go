@@ -0,0 +1,160 @@
+package optimizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+	"gopkg.in/yaml.v3"
+)
+
+// Cardinalities of a join, seen from the rows of the query: a many-to-one
+// join finds at most one row for every row of the query, a one-to-many
+// join may find several and so repeats the query's rows.
+const (
+	CardinalityOneToOne  = "one-to-one"
+	CardinalityManyToOne = "many-to-one"
+	CardinalityOneToMany = "one-to-many"
+)
+
+// JoinInfo is what is declared about one join of the template, keyed by
+// the join's alias. Declarations come from the catalog, from annotations
+// in the template and from a sidecar file given in Options.Joins.
+type JoinInfo struct {
+	// RowPreserving declares that dropping the join does not change the
+	// rows of the query that matter, so that it may be pruned even if it is
+	// an inner or a one-to-many join.
+	RowPreserving bool `json:"row_preserving,omitempty" yaml:"row_preserving,omitempty"`
+	// Cardinality is one of the Cardinality constants, or empty when it
+	// is not known.
+	Cardinality string `json:"cardinality,omitempty" yaml:"cardinality,omitempty"`
+}
+
+func (j JoinInfo) validate(alias string) error {
+	if alias == "" {
+		return &JoinError{Reason: "join alias is empty"}
+	}
+	switch j.Cardinality {
+	case "", CardinalityOneToOne, CardinalityManyToOne, CardinalityOneToMany:
+	default:
+		return &JoinError{Alias: alias, Reason: fmt.Sprintf("unknown cardinality %q", j.Cardinality)}
+	}
+	return nil
+}
+
+// merge adds the declarations of other to j; a cardinality declared by
+// other replaces the one of j.
+func (j JoinInfo) merge(other JoinInfo) JoinInfo {
+	j.RowPreserving = j.RowPreserving || other.RowPreserving
+	if other.Cardinality != "" {
+		j.Cardinality = other.Cardinality
+	}
+	return j
+}
+
+// LoadJoins reads a sidecar file that maps join aliases to their JoinInfo.
+// Files ending in .yaml or .yml are read as YAML, anything else as JSON.
+func LoadJoins(path string) (map[string]JoinInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJoins(data, fileFormat(path))
+}
+
+// ParseJoins decodes and validates join declarations in the given format,
+// which is either "json" or "yaml".
+func ParseJoins(data []byte, format string) (map[string]JoinInfo, error) {
+	var joins map[string]JoinInfo
+	var err error
+	switch format {
+	case "json":
+		err = json.Unmarshal(data, &joins)
+	case "yaml":
+		err = yaml.Unmarshal(data, &joins)
+	default:
+		return nil, fmt.Errorf("unknown join declarations format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for alias, join := range joins {
+		if err := join.validate(alias); err != nil {
+			return nil, err
+		}
+	}
+	return joins, nil
+}
+
+var cardinalityPattern = regexp.MustCompile(`--\s*@cardinality\b(.*)`)
+
+// templateJoins reads the cardinality annotations of a template, comments
+// of the form
+//
+//	-- @cardinality bc one-to-many
+func templateJoins(template string) (map[string]JoinInfo, error) {
+	joins := make(map[string]JoinInfo)
+	for i, line := range strings.Split(template, "\n") {
+		match := cardinalityPattern.FindStringSubmatchIndex(line)
+		if match == nil {
+			continue
+		}
+		fields := strings.Fields(line[match[2]:match[3]])
+		if len(fields) != 2 {
+			return nil, &ParseError{Line: i + 1, Column: match[0] + 1, Err: fmt.Errorf("@cardinality needs a join alias and a cardinality")}
+		}
+		join := joins[fields[0]]
+		join.Cardinality = fields[1]
+		if err := join.validate(fields[0]); err != nil {
+			return nil, &ParseError{Line: i + 1, Column: match[0] + 1, Err: err}
+		}
+		joins[fields[0]] = join
+	}
+	return joins, nil
+}
+
+// RetainedJoin is a join the optimized query keeps although no selected
+// column reads from it, because dropping it could change the rows of the
+// query.
+type RetainedJoin struct {
+	Alias string
+	// Derived is the alias of the derived table the join is in, or empty
+	// for the joins of the template's own FROM clause.
+	Derived     string `json:",omitempty"`
+	JoinType    string
+	Cardinality string `json:",omitempty"`
+	Reason      string
+}
+
+// retainReason returns why a join has to be kept even if no selected
+// column reads from it, or "" when it may be dropped.
+func retainReason(join JoinExpression, info JoinInfo) string {
+	switch {
+	case info.RowPreserving:
+		return ""
+	case info.Cardinality == CardinalityOneToMany:
+		return "one-to-many join repeats rows"
+	case !filtersRows(join.JoinType):
+		return ""
+	case join.on == nil:
+		return "cross join repeats rows"
+	case strings.Contains(strings.ToLower(join.JoinType), "right"):
+		return "right join keeps the rows without a match"
+	}
+	return "inner join drops the rows without a match"
+}
+
+// filtersRows reports whether dropping a join of this type can change the
+// rows of the query even when none of its columns are read: inner and
+// straight joins drop the rows without a match, right joins keep the rows
+// of the joined table.
+func filtersRows(joinType string) bool {
+	switch strings.ToLower(joinType) {
+	case sqlparser.LeftJoinStr, sqlparser.NaturalLeftJoinStr:
+		return false
+	}
+	return true
+}
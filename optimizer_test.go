@@ -0,0 +1,256 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestOptimizeWithoutCatalogKeepsSelection(t *testing.T) {
+	template := `SELECT o.id AS id, o.total AS total FROM orders o`
+	result, err := Optimize(template, []string{"total"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if len(result.Implicit) != 0 {
+		t.Errorf("Implicit = %v, want none without a catalog", result.Implicit)
+	}
+	if len(result.Lineage) != 1 || result.Lineage[0].Alias != "total" {
+		t.Errorf("Lineage = %+v, want only total", result.Lineage)
+	}
+}
+
+func TestOptimizeAddsRequiredColumnsOfCatalog(t *testing.T) {
+	template := `SELECT co.id AS order_id, co.created_at AS order_created_date, co.status AS order_status FROM customer_order co`
+	result, err := Optimize(template, []string{"order_status"}, Options{Catalog: DefaultCatalog()})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	for _, alias := range []string{"order_id", "order_created_date"} {
+		if !slices.Contains(result.Implicit, alias) {
+			t.Errorf("Implicit = %v, want %s", result.Implicit, alias)
+		}
+	}
+
+	_, err = Optimize(`SELECT o.id AS id FROM orders o`, []string{"id"}, Options{Catalog: DefaultCatalog()})
+	var unknown *UnknownColumnError
+	if !errors.As(err, &unknown) {
+		t.Errorf("err = %v, want UnknownColumnError for a REQUIRED column the template lacks", err)
+	}
+}
+
+func TestOptimizeDropsRowPreservingOneToManyJoin(t *testing.T) {
+	template := `SELECT o.id AS order_id, i.sku AS sku
+FROM orders o
+LEFT JOIN item i ON i.order_id = o.id`
+	joins := map[string]JoinInfo{"i": {Cardinality: CardinalityOneToMany, RowPreserving: true}}
+	result, err := Optimize(template, []string{"order_id"}, Options{Joins: joins})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if strings.Contains(result.SQL, "item") {
+		t.Errorf("row preserving one-to-many join was kept:\n%s", result.SQL)
+	}
+
+	joins["i"] = JoinInfo{Cardinality: CardinalityOneToMany}
+	result, err = Optimize(template, []string{"order_id"}, Options{Joins: joins})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if !strings.Contains(result.SQL, "item") {
+		t.Errorf("one-to-many join was dropped:\n%s", result.SQL)
+	}
+}
+
+func TestOptimizeKeepsConditionHooks(t *testing.T) {
+	template := `SELECT o.id AS order_id, r.revoked AS revoked
+FROM orders o
+LEFT JOIN revocation r ON r.order_id = o.id @revocation_date_join_condition_1
+WHERE o.state = 'issued' @encryption_everywhere_condition_1`
+	result, err := Optimize(template, []string{"order_id", "revoked"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	for _, want := range []string{
+		"on r.order_id = o.id @revocation_date_join_condition_1",
+		"where o.state = 'issued' @encryption_everywhere_condition_1",
+	} {
+		if !strings.Contains(result.SQL, want) {
+			t.Errorf("optimized query lacks %q:\n%s", want, result.SQL)
+		}
+	}
+
+	result, err = Optimize(template, []string{"order_id"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if strings.Contains(result.SQL, "@revocation_date_join_condition_1") {
+		t.Errorf("hook of a dropped join was kept:\n%s", result.SQL)
+	}
+	if !strings.Contains(result.SQL, "@encryption_everywhere_condition_1") {
+		t.Errorf("hook of the WHERE clause was dropped:\n%s", result.SQL)
+	}
+}
+
+func TestOptimizeKeepsTemplateJoinOrder(t *testing.T) {
+	template := `SELECT o.id AS order_id, c.name AS customer, c.email AS email, a.city AS city, a.zip AS zip
+FROM orders o
+LEFT JOIN customer c ON c.id = o.customer_id
+LEFT JOIN address a ON a.customer_id = c.id
+LEFT JOIN note n ON n.order_id = o.id`
+	from := func(columns ...string) string {
+		t.Helper()
+		result, err := Optimize(template, columns, Options{})
+		if err != nil {
+			t.Fatalf("Optimize(%v): %v", columns, err)
+		}
+		return result.SQL[strings.Index(result.SQL, "from"):]
+	}
+	first, second := from("city", "customer"), from("email", "zip")
+	if first != second {
+		t.Errorf("selections keeping the same joins give different joins:\n%s\n\n%s", first, second)
+	}
+	if strings.Index(first, "customer as c") > strings.Index(first, "address as a") {
+		t.Errorf("joins are out of template order:\n%s", first)
+	}
+}
+
+func TestOptimizePrunesJoinsOfCommaItems(t *testing.T) {
+	template := `SELECT a.x AS x, c.y AS y, d.z AS z
+FROM a, b LEFT JOIN c ON c.b_id = b.id LEFT JOIN d ON d.b_id = b.id
+WHERE a.id = b.a_id`
+	for _, test := range []struct {
+		columns       []string
+		kept, dropped []string
+	}{
+		{[]string{"x"}, nil, []string{"join c", "join d"}},
+		{[]string{"x", "y"}, []string{"join c"}, []string{"join d"}},
+		{[]string{"x", "z"}, []string{"join d"}, []string{"join c"}},
+	} {
+		result, err := Optimize(template, test.columns, Options{})
+		if err != nil {
+			t.Fatalf("Optimize(%v): %v", test.columns, err)
+		}
+		if !strings.Contains(result.SQL, "where a.id = b.a_id") {
+			t.Errorf("Optimize(%v) dropped the comma join of b:\n%s", test.columns, result.SQL)
+		}
+		for _, join := range test.kept {
+			if !strings.Contains(result.SQL, join) {
+				t.Errorf("Optimize(%v) dropped %s:\n%s", test.columns, join, result.SQL)
+			}
+		}
+		for _, join := range test.dropped {
+			if strings.Contains(result.SQL, join) {
+				t.Errorf("Optimize(%v) kept %s:\n%s", test.columns, join, result.SQL)
+			}
+		}
+	}
+}
+
+func TestOptimizeLogsUnresolvedColumns(t *testing.T) {
+	template := `SELECT o.a AS a, b AS b
+FROM orders o
+LEFT JOIN cert c ON c.order_id = o.id`
+	var log bytes.Buffer
+	if _, err := Optimize(template, []string{"b"}, Options{Log: &log}); err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if !strings.Contains(log.String(), "Not found above! b:") {
+		t.Errorf("unresolved column b was not logged, log:\n%s", log.String())
+	}
+
+	schema, err := ParseSchema("CREATE TABLE orders (id int, a int); CREATE TABLE cert (id int, order_id int, b int);")
+	if err != nil {
+		t.Fatalf("ParseSchema: %v", err)
+	}
+	log.Reset()
+	result, err := Optimize(template, []string{"b"}, Options{Log: &log, Schema: schema})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if log.Len() != 0 {
+		t.Errorf("resolved column was logged:\n%s", log.String())
+	}
+	if !strings.Contains(result.SQL, "join cert") {
+		t.Errorf("join of the resolved column was dropped:\n%s", result.SQL)
+	}
+}
+
+func TestOptimizeKeepsJoinsOfAggregatingQuery(t *testing.T) {
+	template := `SELECT o.id AS a, SUM(o.total) AS s, c.n AS cn
+FROM orders o
+LEFT JOIN contact c ON c.oid = o.id
+GROUP BY o.id`
+	result, err := Optimize(template, []string{"a", "s"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if !strings.Contains(result.SQL, "left join contact") {
+		t.Errorf("join of an aggregating query was dropped:\n%s", result.SQL)
+	}
+	if len(result.RetainedJoins) != 1 || result.RetainedJoins[0].Alias != "c" {
+		t.Errorf("RetainedJoins = %+v, want c", result.RetainedJoins)
+	}
+
+	joins := map[string]JoinInfo{"c": {Cardinality: CardinalityManyToOne}}
+	result, err = Optimize(template, []string{"a", "s"}, Options{Joins: joins})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if strings.Contains(result.SQL, "contact") {
+		t.Errorf("many-to-one join of an aggregating query was kept:\n%s", result.SQL)
+	}
+}
+
+func TestLineageJSONIsAnArrayOfColumns(t *testing.T) {
+	template := `SELECT o.id AS order_id, c.name AS customer
+FROM orders o
+JOIN customer c ON c.id = o.customer_id`
+	result, err := Optimize(template, []string{"order_id"}, Options{})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	data, err := result.LineageJSON()
+	if err != nil {
+		t.Fatalf("LineageJSON: %v", err)
+	}
+	var lineage []QueryInfo
+	if err := json.Unmarshal(data, &lineage); err != nil || len(lineage) != 1 || lineage[0].Alias != "order_id" {
+		t.Errorf("LineageJSON = %s, want an array with the lineage of order_id (%v)", data, err)
+	}
+	data, err = result.RetainedJoinsJSON()
+	if err != nil {
+		t.Fatalf("RetainedJoinsJSON: %v", err)
+	}
+	var retained []RetainedJoin
+	if err := json.Unmarshal(data, &retained); err != nil || len(retained) != 1 || retained[0].Alias != "c" {
+		t.Errorf("RetainedJoinsJSON = %s, want an array with c (%v)", data, err)
+	}
+}
+
+func TestLoadJoinsReadsYAMLAndJSON(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"joins.yaml": "c:\n  cardinality: many-to-one\n",
+		"joins.yml":  "c:\n  cardinality: many-to-one\n",
+		"joins.json": `{"c": {"cardinality": "many-to-one"}}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		joins, err := LoadJoins(path)
+		if err != nil {
+			t.Fatalf("LoadJoins(%s): %v", name, err)
+		}
+		if joins["c"].Cardinality != CardinalityManyToOne {
+			t.Errorf("LoadJoins(%s) = %+v, want c many-to-one", name, joins)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package optimizer
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// printPromptHelp lists the commands understood by promptSelection.
+func printPromptHelp(catalog *Catalog) {
+	fmt.Println("\n(Type 'all' to include all columns)")
+	fmt.Println("(Type 'default' to include only DEFAULT columns)")
+	for _, name := range catalog.PresetNames() {
+		fmt.Printf("(Type '%s' to include the %s preset)\n", name, name)
+	}
+	fmt.Println("(Type indexes, ranges such as 52-67 or aliases such as common_name, separated by commas)")
+	fmt.Println("(Type section:\"name\" or subsection:\"name\" to include a whole section)")
+	fmt.Println("(Prefix any of these with - to remove it again, for example -18)")
+	fmt.Println("(Type 'list' to show the current selection and 'undo' to revert the last change)")
+	fmt.Println("(Type 'done' to stop after entering custom column indexes)")
+	fmt.Println()
+}
+
+// promptSelection reads column selections line by line until the user
+// types done, picks a preset or the input ends, and returns the selected
+// catalog indexes in ascending order. A line with a mistake is reported
+// and ignored as a whole, so one typo does not end the session.
+func promptSelection(catalog *Catalog, scanner *bufio.Scanner) []int {
+	var selection []int
+	var history [][]int
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+		case line == "done":
+			sort.Ints(selection)
+			return selection
+		case line == "list":
+			printSelection(catalog, selection)
+			continue
+		case line == "undo":
+			if len(history) == 0 {
+				fmt.Println("Nothing to undo")
+				continue
+			}
+			selection = history[len(history)-1]
+			history = history[:len(history)-1]
+			fmt.Printf("Reverted, %d columns selected\n", len(selection))
+			continue
+		case line == PresetAll || line == PresetDefault || slices.Contains(catalog.PresetNames(), line):
+			presetColumns, _ := catalog.Preset(line)
+			if drift := catalog.DefaultDrift(); line == PresetDefault && !drift.Empty() {
+				fmt.Printf("Warning: stored DEFAULT preset differs from the catalog flags (%s)\n", drift)
+			}
+			selection = selection[:0]
+			for _, alias := range presetColumns {
+				selection = append(selection, catalog.Index(alias))
+			}
+			sort.Ints(selection)
+			return selection
+		}
+
+		next, err := applySelection(catalog, selection, SplitRefs(line))
+		if err != nil {
+			fmt.Printf("%v, nothing changed\n", err)
+			continue
+		}
+		if !slices.Equal(next, selection) {
+			history = append(history, selection)
+			selection = next
+		}
+	}
+
+	sort.Ints(selection)
+	return selection
+}
+
+// applySelection applies the references of one prompt line to a copy of
+// the selection. It reports columns that were already selected, or not
+// selected when removed, but only fails on references the catalog does
+// not know.
+func applySelection(catalog *Catalog, selection []int, refs []string) ([]int, error) {
+	next := append([]int(nil), selection...)
+	var duplicates, absent []string
+
+	for _, ref := range refs {
+		exclude := strings.HasPrefix(ref, "-")
+		aliases, err := catalog.resolveRef(strings.TrimPrefix(ref, "-"))
+		if err != nil {
+			return nil, err
+		}
+		for _, alias := range aliases {
+			index := catalog.Index(alias)
+			position := slices.Index(next, index)
+			switch {
+			case exclude && position == -1:
+				absent = append(absent, alias)
+			case exclude:
+				next = slices.Delete(next, position, position+1)
+			case position != -1:
+				duplicates = append(duplicates, alias)
+			default:
+				next = append(next, index)
+			}
+		}
+	}
+
+	if len(duplicates) > 0 {
+		fmt.Printf("Already selected: %s\n", strings.Join(duplicates, ", "))
+	}
+	if len(absent) > 0 {
+		fmt.Printf("Not selected, nothing to remove: %s\n", strings.Join(absent, ", "))
+	}
+	return next, nil
+}
+
+func printSelection(catalog *Catalog, selection []int) {
+	if len(selection) == 0 {
+		fmt.Println("No columns selected")
+		return
+	}
+	sorted := append([]int(nil), selection...)
+	sort.Ints(sorted)
+	for _, index := range sorted {
+		fmt.Printf("%d. %s\n", index, catalog.Columns[index].Alias)
+	}
+}
@@ -0,0 +1,299 @@
+package optimizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// Schema holds the columns of the tables templates read from, as declared
+// by CREATE TABLE statements. Tables are known by their name without the
+// database, column names are compared without regard to case.
+type Schema struct {
+	tables map[string][]string
+}
+
+var createTablePattern = regexp.MustCompile(`(?i)^\s*create\s+(temporary\s+)?table\b`)
+
+// LoadSchema reads the CREATE TABLE statements of DDL files, such as the
+// output of mysqldump --no-data.
+func LoadSchema(paths ...string) (*Schema, error) {
+	schema := &Schema{tables: make(map[string][]string)}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := schema.add(string(data)); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return schema, nil
+}
+
+// ParseSchema reads the CREATE TABLE statements of ddl. Other statements
+// are skipped.
+func ParseSchema(ddl string) (*Schema, error) {
+	schema := &Schema{tables: make(map[string][]string)}
+	if err := schema.add(ddl); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (s *Schema) add(ddl string) error {
+	pieces, err := sqlparser.SplitStatementToPieces(ddl)
+	if err != nil {
+		return &SchemaError{Reason: err.Error()}
+	}
+	for _, piece := range pieces {
+		if !createTablePattern.MatchString(piece) {
+			continue
+		}
+		// the lenient parser gives up on CREATE TABLE statements it does
+		// not understand without an error, and returns them without
+		// columns
+		statement, err := sqlparser.ParseStrictDDL(piece)
+		if err != nil {
+			return &SchemaError{Reason: fmt.Sprintf("%v in %q", err, strings.TrimSpace(piece))}
+		}
+		create, ok := statement.(*sqlparser.DDL)
+		if !ok || create.TableSpec == nil {
+			return &SchemaError{Reason: fmt.Sprintf("no column definitions in %q", strings.TrimSpace(piece))}
+		}
+		table := create.NewName.Name.String()
+		if _, ok := s.tables[table]; ok {
+			return &SchemaError{Table: table, Reason: "table is created more than once"}
+		}
+		var columns []string
+		for _, column := range create.TableSpec.Columns {
+			columns = append(columns, column.Name.Lowered())
+		}
+		s.tables[table] = columns
+	}
+	return nil
+}
+
+// columns returns the lowercase names of the columns of table, and whether
+// the table is in the schema.
+func (s *Schema) columns(table string) ([]string, bool) {
+	if s == nil {
+		return nil, false
+	}
+	columns, ok := s.tables[table]
+	return columns, ok
+}
+
+// scope returns the columns of the tables a FROM clause makes visible, by
+// their alias. Tables missing from the schema, and derived tables whose
+// select list has a *, are left out, as their columns are not known.
+func (s *Schema) scope(from sqlparser.TableExprs) map[string][]string {
+	scope := make(map[string][]string)
+	var add func(tableExpr sqlparser.TableExpr)
+	add = func(tableExpr sqlparser.TableExpr) {
+		switch t := tableExpr.(type) {
+		case *sqlparser.AliasedTableExpr:
+			alias := tableExprAliases(t)
+			if len(alias) == 0 {
+				return
+			}
+			switch expr := t.Expr.(type) {
+			case sqlparser.TableName:
+				if columns, ok := s.columns(expr.Name.String()); ok {
+					scope[alias[0]] = columns
+				}
+			case *sqlparser.Subquery:
+				if sel, ok := expr.Select.(*sqlparser.Select); ok && s != nil {
+					names := selectNames(sel.SelectExprs)
+					if !slices.Contains(names, "*") {
+						for i := range names {
+							names[i] = strings.ToLower(names[i])
+						}
+						scope[alias[0]] = names
+					}
+				}
+			}
+		case *sqlparser.JoinTableExpr:
+			add(t.LeftExpr)
+			add(t.RightExpr)
+		case *sqlparser.ParenTableExpr:
+			for _, inner := range t.Exprs {
+				add(inner)
+			}
+		}
+	}
+	for _, tableExpr := range from {
+		add(tableExpr)
+	}
+	return scope
+}
+
+// resolveColumns qualifies the unqualified columns of the outer query of
+// sel with the alias of the one table in scope that has them, and fails
+// with an AmbiguousColumnError when several have. Columns no known table
+// has are left as they are, and so are the names of the select list used
+// by GROUP BY, HAVING and ORDER BY. A column shared by a USING or NATURAL
+// join is a single column of the joined tables, it is qualified with the
+// first of them.
+func resolveColumns(sel *sqlparser.Select, schema *Schema) error {
+	scope := schema.scope(sel.From)
+	var aliases []string
+	for _, tableExpr := range sel.From {
+		aliases = append(aliases, tableExprAliases(tableExpr)...)
+	}
+	shared := sharedNames(sel.From, scope)
+
+	return walkUnqualified(sel, func(column *sqlparser.ColName) error {
+		name := column.Name.Lowered()
+		var tables []string
+		for _, alias := range aliases {
+			if slices.Contains(scope[alias], name) {
+				tables = append(tables, alias)
+			}
+		}
+		if len(tables) > 1 && !slices.Contains(shared, name) {
+			return &AmbiguousColumnError{Column: column.Name.String(), Tables: tables}
+		}
+		if len(tables) > 0 {
+			column.Qualifier = sqlparser.TableName{Name: sqlparser.NewTableIdent(tables[0])}
+		}
+		return nil
+	})
+}
+
+// unqualifiedColumns returns the names of the columns of the outer query of
+// sel that are still unqualified, other than the placeholder of the
+// revocation date column.
+func unqualifiedColumns(sel *sqlparser.Select) []string {
+	var names []string
+	_ = walkUnqualified(sel, func(column *sqlparser.ColName) error {
+		if name := column.Name.String(); name != revocationDateColumn && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names
+}
+
+// walkUnqualified calls visit with every unqualified column of the outer
+// query of sel, in its select expressions, clauses and join conditions,
+// and stops at the first error. The names of the select list used by
+// GROUP BY, HAVING and ORDER BY are not columns.
+func walkUnqualified(sel *sqlparser.Select, visit func(column *sqlparser.ColName) error) error {
+	walk := func(node sqlparser.SQLNode, skip []string) error {
+		return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+			switch node := node.(type) {
+			case *sqlparser.ColName:
+				if !node.Qualifier.IsEmpty() || slices.Contains(skip, node.Name.Lowered()) {
+					return false, nil
+				}
+				return false, visit(node)
+			case *sqlparser.Subquery:
+				// the unqualified columns of a subquery with tables of its
+				// own are read from those
+				return len(scopeAliases(node.Select)) == 0, nil
+			}
+			return true, nil
+		}, node)
+	}
+
+	var names []string
+	for _, name := range selectNames(sel.SelectExprs) {
+		names = append(names, strings.ToLower(name))
+	}
+	for _, node := range []sqlparser.SQLNode{sel.SelectExprs, sel.Where} {
+		if err := walk(node, nil); err != nil {
+			return err
+		}
+	}
+	for _, node := range []sqlparser.SQLNode{sel.GroupBy, sel.Having, sel.OrderBy} {
+		if err := walk(node, names); err != nil {
+			return err
+		}
+	}
+	for _, on := range joinConditions(sel.From) {
+		if err := walk(on, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedNames returns the lowercase names of the columns USING and
+// NATURAL joins of a FROM clause make one. The columns a NATURAL join
+// shares are only known when the columns of all the tables it joins are.
+func sharedNames(from sqlparser.TableExprs, scope map[string][]string) []string {
+	var names []string
+	var add func(tableExpr sqlparser.TableExpr)
+	add = func(tableExpr sqlparser.TableExpr) {
+		switch t := tableExpr.(type) {
+		case *sqlparser.JoinTableExpr:
+			for _, column := range t.Condition.Using {
+				names = append(names, column.Lowered())
+			}
+			if isNaturalJoin(t.Join) {
+				natural, _ := naturalColumns(scope, tableExprAliases(t.LeftExpr), tableExprAliases(t.RightExpr))
+				names = append(names, natural...)
+			}
+			add(t.LeftExpr)
+			add(t.RightExpr)
+		case *sqlparser.ParenTableExpr:
+			for _, inner := range t.Exprs {
+				add(inner)
+			}
+		}
+	}
+	for _, tableExpr := range from {
+		add(tableExpr)
+	}
+	return names
+}
+
+// naturalColumns returns the lowercase names of the columns the tables on
+// the right of a NATURAL join share with those on its left, found in scope
+// by their aliases, and whether the columns of all of them are known. It
+// returns no names when they are not.
+func naturalColumns(scope map[string][]string, left, right []string) ([]string, bool) {
+	var leftColumns []string
+	for _, alias := range left {
+		columns, ok := scope[alias]
+		if !ok {
+			return nil, false
+		}
+		leftColumns = append(leftColumns, columns...)
+	}
+	var names []string
+	for _, alias := range right {
+		columns, ok := scope[alias]
+		if !ok {
+			return nil, false
+		}
+		for _, column := range columns {
+			if slices.Contains(leftColumns, column) && !slices.Contains(names, column) {
+				names = append(names, column)
+			}
+		}
+	}
+	return names, true
+}
+
+// joinConditions returns the ON conditions of the joins of a FROM clause.
+func joinConditions(from sqlparser.TableExprs) []sqlparser.Expr {
+	var conditions []sqlparser.Expr
+	for _, tableExpr := range from {
+		switch t := tableExpr.(type) {
+		case *sqlparser.JoinTableExpr:
+			conditions = append(conditions, joinConditions(sqlparser.TableExprs{t.LeftExpr, t.RightExpr})...)
+			if t.Condition.On != nil {
+				conditions = append(conditions, t.Condition.On)
+			}
+		case *sqlparser.ParenTableExpr:
+			conditions = append(conditions, joinConditions(t.Exprs)...)
+		}
+	}
+	return conditions
+}
@@ -0,0 +1,155 @@
+package optimizer
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Prefixes of textual references to whole parts of the catalog.
+const (
+	sectionPrefix    = "section:"
+	subsectionPrefix = "subsection:"
+)
+
+var rangePattern = regexp.MustCompile(`^(\d+)\s*-\s*(\d+)$`)
+
+// Select returns the aliases of the entries matched by any include item
+// and by none of the exclude items, in index order. Every item must match
+// at least one entry.
+//
+//	catalog.Select(
+//		[]PresetItem{{Section: "Order details"}},
+//		[]PresetItem{{Subsection: "Billing and shipping information"}},
+//	)
+func (c *Catalog) Select(include, exclude []PresetItem) ([]string, error) {
+	for _, item := range append(append([]PresetItem(nil), include...), exclude...) {
+		if slices.IndexFunc(c.Columns, item.matches) == -1 {
+			return nil, &UnknownSectionError{Item: item}
+		}
+	}
+	excluded := c.selectItems(exclude)
+	var aliases []string
+	for _, alias := range c.selectItems(include) {
+		if !slices.Contains(excluded, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases, nil
+}
+
+// Resolve turns column references into aliases. A reference is a catalog
+// alias, a catalog index, an index range such as 52-67, section:"name" or
+// subsection:"name". A section
+// reference that matches no section falls back to the subsections of that
+// name. Prefixed with "-", a reference removes the columns it names from
+// those selected by the references before it. The result keeps the order
+// of refs.
+func (c *Catalog) Resolve(refs []string) ([]string, error) {
+	var columns []string
+	for _, ref := range refs {
+		exclude := strings.HasPrefix(ref, "-")
+		aliases, err := c.resolveRef(strings.TrimPrefix(ref, "-"))
+		if err != nil {
+			return nil, err
+		}
+		for _, alias := range aliases {
+			index := slices.Index(columns, alias)
+			switch {
+			case exclude && index != -1:
+				columns = slices.Delete(columns, index, index+1)
+			case !exclude && index == -1:
+				columns = append(columns, alias)
+			}
+		}
+	}
+	return columns, nil
+}
+
+// resolveRef returns the aliases named by a single reference without its
+// "-" prefix.
+func (c *Catalog) resolveRef(ref string) ([]string, error) {
+	if index, err := strconv.Atoi(ref); err == nil {
+		if index < 0 || index >= len(c.Columns) {
+			return nil, &ColumnIndexError{Index: index, Size: len(c.Columns)}
+		}
+		return []string{c.Columns[index].Alias}, nil
+	}
+
+	if match := rangePattern.FindStringSubmatch(ref); match != nil {
+		start, _ := strconv.Atoi(match[1])
+		end, _ := strconv.Atoi(match[2])
+		if start > end {
+			return nil, &InvalidRangeError{Start: start, End: end}
+		}
+		if end >= len(c.Columns) {
+			return nil, &ColumnIndexError{Index: end, Size: len(c.Columns)}
+		}
+		return c.Aliases()[start : end+1], nil
+	}
+
+	if item, ok := parseSectionRef(ref); ok {
+		if item.Section != "" && slices.IndexFunc(c.Columns, item.matches) == -1 {
+			item = PresetItem{Subsection: item.Section}
+		}
+		return c.Select([]PresetItem{item}, nil)
+	}
+
+	if c.Index(ref) == -1 {
+		return nil, &UnknownAliasError{Alias: ref}
+	}
+	return []string{ref}, nil
+}
+
+// parseSectionRef parses section:"name" and subsection:"name". The quotes
+// are optional.
+func parseSectionRef(ref string) (PresetItem, bool) {
+	var item PresetItem
+	switch {
+	case strings.HasPrefix(ref, sectionPrefix):
+		item.Section = unquote(strings.TrimPrefix(ref, sectionPrefix))
+	case strings.HasPrefix(ref, subsectionPrefix):
+		item.Subsection = unquote(strings.TrimPrefix(ref, subsectionPrefix))
+	default:
+		return item, false
+	}
+	return item, true
+}
+
+func unquote(text string) string {
+	text = strings.TrimSpace(text)
+	if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		return text[1 : len(text)-1]
+	}
+	return text
+}
+
+// SplitRefs splits a comma separated list of column references. Commas
+// inside double quotes, as in section:"Renewal, reissue, and duplicate
+// information", do not split.
+func SplitRefs(list string) []string {
+	var refs []string
+	var current strings.Builder
+	quoted := false
+	flush := func() {
+		if ref := strings.TrimSpace(current.String()); ref != "" {
+			refs = append(refs, ref)
+		}
+		current.Reset()
+	}
+	for _, r := range list {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case r == ',' && !quoted:
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return refs
+}
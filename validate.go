@@ -0,0 +1,264 @@
+package optimizer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// Validate checks a template against a schema: every table of its FROM
+// clause has to be in the schema, every column of its select expressions,
+// join conditions and clauses has to be a column of one of the tables in
+// scope, and every column of a USING join has to be a column of the joined
+// table and of exactly one table on its left. Derived tables and
+// subqueries are checked the same way.
+//
+// It returns a ParseError or NotSelectError when the template cannot be
+// read, and a ValidationError with every problem found otherwise. Columns
+// of derived tables whose select list has a * are not checked.
+func Validate(template string, schema *Schema) error {
+	sel, err := parseTemplate(template)
+	if err != nil {
+		return err
+	}
+
+	v := &validator{schema: schema, template: template, text: preprocessing(template)}
+	v.checkSelect(sel, nil)
+	if len(v.problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		a, b := v.problems[i], v.problems[j]
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+	return &ValidationError{Problems: v.problems}
+}
+
+type validator struct {
+	schema   *Schema
+	template string
+	// text is the template as it is parsed. The names the checks visit
+	// are located in it in the order they are written, each one after
+	// offset, the end of the name located before it.
+	text     string
+	offset   int
+	problems []Problem
+}
+
+// level is the scope of one SELECT: the aliases of its tables and the
+// columns of those that are known.
+type level struct {
+	aliases []string
+	columns map[string][]string
+	shared  []string
+}
+
+func (v *validator) checkSelect(stmt sqlparser.SelectStatement, outer []level) {
+	switch stmt := stmt.(type) {
+	case *sqlparser.Union:
+		v.checkSelect(stmt.Left, outer)
+		v.checkSelect(stmt.Right, outer)
+	case *sqlparser.ParenSelect:
+		v.checkSelect(stmt.Select, outer)
+	case *sqlparser.Select:
+		scope := level{columns: v.schema.scope(stmt.From)}
+		for _, tableExpr := range stmt.From {
+			scope.aliases = append(scope.aliases, tableExprAliases(tableExpr)...)
+		}
+		scope.shared = sharedNames(stmt.From, scope.columns)
+		levels := append([]level{scope}, outer...)
+
+		// the parts are checked in the order they are written, so that
+		// the names in them are found where they are
+		v.checkExpr(stmt.SelectExprs, levels, nil)
+		for _, tableExpr := range stmt.From {
+			v.checkFrom(tableExpr, levels)
+		}
+		v.checkExpr(stmt.Where, levels, nil)
+		// GROUP BY, HAVING and ORDER BY may name the select list
+		var names []string
+		for _, name := range selectNames(stmt.SelectExprs) {
+			names = append(names, strings.ToLower(name))
+		}
+		for _, clause := range []sqlparser.SQLNode{stmt.GroupBy, stmt.Having, stmt.OrderBy} {
+			v.checkExpr(clause, levels, names)
+		}
+	}
+}
+
+// checkFrom checks the tables, join conditions and derived tables of a
+// FROM item.
+func (v *validator) checkFrom(tableExpr sqlparser.TableExpr, levels []level) {
+	switch t := tableExpr.(type) {
+	case *sqlparser.AliasedTableExpr:
+		switch expr := t.Expr.(type) {
+		case sqlparser.TableName:
+			at := v.locate(tablePattern(expr.Name.String()))
+			if _, ok := v.schema.columns(expr.Name.String()); !ok {
+				v.report(at, "unknown table %q", sqlparser.String(expr))
+			}
+		case *sqlparser.Subquery:
+			// a derived table sees none of the tables around it
+			v.checkSelect(expr.Select, nil)
+		}
+	case *sqlparser.ParenTableExpr:
+		for _, inner := range t.Exprs {
+			v.checkFrom(inner, levels)
+		}
+	case *sqlparser.JoinTableExpr:
+		v.checkFrom(t.LeftExpr, levels)
+		v.checkFrom(t.RightExpr, levels)
+		if t.Condition.On != nil {
+			v.checkExpr(t.Condition.On, levels, nil)
+		}
+		for _, column := range t.Condition.Using {
+			v.checkUsing(column, tableExprAliases(t.LeftExpr), tableExprAliases(t.RightExpr), levels[0])
+		}
+	}
+}
+
+func (v *validator) checkUsing(column sqlparser.ColIdent, left, right []string, scope level) {
+	at := v.locate(columnPattern("", column.String()))
+	if tables, known := scope.having(right, column.Lowered()); known && len(tables) == 0 {
+		v.report(at, "USING column %q is not a column of %s", column.String(), strings.Join(right, ", "))
+	}
+	switch tables, known := scope.having(left, column.Lowered()); {
+	case known && len(tables) == 0:
+		v.report(at, "USING column %q is not a column of any table on the left of the join", column.String())
+	case len(tables) > 1:
+		v.report(at, "USING column %q is ambiguous: tables %s on the left of the join have it", column.String(), strings.Join(tables, ", "))
+	}
+}
+
+// checkExpr checks the columns node reads, and the subqueries in it.
+// Unqualified columns named in skip are not checked.
+func (v *validator) checkExpr(node sqlparser.SQLNode, levels []level, skip []string) {
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch node := node.(type) {
+		case *sqlparser.ColName:
+			at := v.locate(columnPattern(node.Qualifier.Name.String(), node.Name.String()))
+			if node.Qualifier.IsEmpty() && slices.Contains(skip, node.Name.Lowered()) {
+				break
+			}
+			v.checkColumn(node, levels, at)
+		case *sqlparser.StarExpr:
+			if qualifier := node.TableName.Name.String(); qualifier != "" {
+				if at := v.locate(tablePattern(qualifier)); innermostLevel(levels, qualifier) == -1 {
+					v.report(at, "unknown table alias %q", qualifier)
+				}
+			}
+		case *sqlparser.Subquery:
+			v.checkSelect(node.Select, levels)
+			return false, nil
+		}
+		return true, nil
+	}, node)
+}
+
+// checkColumn checks a column reference found at the offset at of the
+// text.
+func (v *validator) checkColumn(column *sqlparser.ColName, levels []level, at int) {
+	name, qualifier := column.Name.Lowered(), column.Qualifier.Name.String()
+	if name == revocationDateColumn {
+		return
+	}
+
+	if qualifier != "" {
+		i := innermostLevel(levels, qualifier)
+		if i == -1 {
+			v.report(at, "unknown table alias %q", qualifier)
+			return
+		}
+		if columns, ok := levels[i].columns[qualifier]; ok && !slices.Contains(columns, name) {
+			v.report(at, "unknown column %q: not a column of %s", column.Name.String(), qualifier)
+		}
+		return
+	}
+
+	// an unqualified column is read from the innermost SELECT that has
+	// it
+	for _, scope := range levels {
+		tables, known := scope.having(scope.aliases, name)
+		switch {
+		case len(tables) > 1 && !slices.Contains(scope.shared, name):
+			v.report(at, "column %q is ambiguous: tables %s have it", column.Name.String(), strings.Join(tables, ", "))
+			return
+		case len(tables) > 0 || !known:
+			return
+		}
+	}
+	v.report(at, "unknown column %q: not a column of any table in scope", column.Name.String())
+}
+
+// having returns the aliases of the tables that have the named column,
+// and whether the columns of all of them are known.
+func (l level) having(aliases []string, name string) ([]string, bool) {
+	var tables []string
+	known := true
+	for _, alias := range aliases {
+		columns, ok := l.columns[alias]
+		if !ok {
+			known = false
+		}
+		if slices.Contains(columns, name) {
+			tables = append(tables, alias)
+		}
+	}
+	return tables, known
+}
+
+// innermostLevel returns the index of the innermost level with the alias,
+// or -1.
+func innermostLevel(levels []level, alias string) int {
+	return slices.IndexFunc(levels, func(l level) bool { return slices.Contains(l.aliases, alias) })
+}
+
+// locate returns the offset of the first match of pattern after the names
+// located so far, and moves past it. When there is none it falls back to
+// the first match in the whole text, and to -1 when there is no match at
+// all.
+func (v *validator) locate(pattern *regexp.Regexp) int {
+	if match := pattern.FindStringSubmatchIndex(v.text[v.offset:]); match != nil {
+		at := v.offset + match[2]
+		v.offset += match[3]
+		return at
+	}
+	if match := pattern.FindStringSubmatchIndex(v.text); match != nil {
+		return match[2]
+	}
+	return -1
+}
+
+// report records a problem at the offset at of the text, or without a
+// position when at is -1.
+func (v *validator) report(at int, format string, args ...interface{}) {
+	problem := Problem{Message: fmt.Sprintf(format, args...)}
+	if at != -1 {
+		problem.Line, problem.Column = templatePosition(v.template, at)
+	}
+	v.problems = append(v.problems, problem)
+}
+
+// identifierPattern matches an identifier with or without backquotes.
+func identifierPattern(name string) string {
+	return "`?" + regexp.QuoteMeta(name) + "`?"
+}
+
+// tablePattern matches a table name or alias that is not part of a longer
+// name.
+func tablePattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(?:^|[^\w.])(` + identifierPattern(name) + `)(?:[^\w]|$)`)
+}
+
+// columnPattern matches a column reference, qualified or not.
+func columnPattern(qualifier, name string) *regexp.Regexp {
+	reference := identifierPattern(name)
+	if qualifier != "" {
+		reference = identifierPattern(qualifier) + `\s*\.\s*` + reference
+	}
+	return regexp.MustCompile(`(?i)(?:^|[^\w.])(` + reference + `)(?:[^\w.]|$)`)
+}
@@ -0,0 +1,72 @@
+package optimizer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateLocatesEveryProblem(t *testing.T) {
+	template := `SELECT o.id AS order_id,
+	o.nope AS nope,
+	c.name AS customer
+FROM orders o
+LEFT JOIN customer c ON c.id = o.customer_id
+LEFT JOIN (SELECT id, total FROM invoice) i ON i.id = o.id
+WHERE o.nope > 0 AND i.total > 0`
+	schema, err := ParseSchema(`CREATE TABLE orders (id int, customer_id int);
+CREATE TABLE customer (id int, name varchar(64));
+CREATE TABLE invoice (id int, total int);`)
+	if err != nil {
+		t.Fatalf("ParseSchema: %v", err)
+	}
+
+	err = Validate(template, schema)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Validate = %v, want a ValidationError", err)
+	}
+	want := []Problem{
+		{Line: 2, Column: 2, Message: `unknown column "nope": not a column of o`},
+		{Line: 7, Column: 7, Message: `unknown column "nope": not a column of o`},
+	}
+	if len(validationErr.Problems) != len(want) {
+		t.Fatalf("Problems = %v, want %v", validationErr.Problems, want)
+	}
+	for i := range want {
+		if validationErr.Problems[i] != want[i] {
+			t.Errorf("Problems[%d] = %v, want %v", i, validationErr.Problems[i], want[i])
+		}
+	}
+}
+
+func TestValidateAcceptsKnownColumns(t *testing.T) {
+	schema, err := ParseSchema(`CREATE TABLE orders (id int, total int);`)
+	if err != nil {
+		t.Fatalf("ParseSchema: %v", err)
+	}
+	if err := Validate(`SELECT o.id AS id, total FROM orders o ORDER BY total`, schema); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestNaturalJoinSharesColumns(t *testing.T) {
+	schema, err := ParseSchema(`CREATE TABLE orders (id int, customer_id int);
+CREATE TABLE customer (customer_id int, name varchar(64));`)
+	if err != nil {
+		t.Fatalf("ParseSchema: %v", err)
+	}
+	template := `SELECT o.id AS id, name AS name, customer_id AS cid
+FROM orders o
+NATURAL LEFT JOIN customer c`
+	if err := Validate(template, schema); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	result, err := Optimize(template, []string{"cid", "name"}, Options{Schema: schema})
+	if err != nil {
+		t.Fatalf("Optimize: %v", err)
+	}
+	if !strings.Contains(result.SQL, "natural left join customer as c") || !strings.Contains(result.SQL, "o.customer_id as cid") {
+		t.Errorf("natural join or its shared column was not kept:\n%s", result.SQL)
+	}
+}